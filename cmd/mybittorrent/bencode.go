@@ -1,152 +1,460 @@
 package main
 
 import (
-	"crypto/sha1"
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"reflect"
+	"slices"
 	"strconv"
 	"strings"
-	"unicode"
+)
+
+const (
+	defaultMaxDepth        = 64
+	defaultMaxStringLength = 32 << 20
+)
 
-	bencode "github.com/jackpal/bencode-go"
+var (
+	ErrUnexpectedEOF   = errors.New("unexpected end of input")
+	ErrUnterminated    = errors.New("unterminated value")
+	ErrUnexpectedByte  = errors.New("unexpected byte")
+	ErrBadInteger      = errors.New("invalid integer")
+	ErrLeadingZero     = errors.New("leading zero in number")
+	ErrNegativeZero    = errors.New("negative zero")
+	ErrBadStringLength = errors.New("invalid string length")
+	ErrTruncatedString = errors.New("truncated string")
+	ErrStringTooLong   = errors.New("string exceeds maximum length")
+	ErrMaxDepth        = errors.New("maximum nesting depth exceeded")
+	ErrDuplicateKey    = errors.New("duplicate dictionary key")
+	ErrTrailingData    = errors.New("unexpected trailing data")
 )
 
-func decodeBencode(input string) (any, error) {
-	value, _, err := decodeBencodeImpl(input)
-	return value, err
+// SyntaxError describes malformed bencode input. Err is one of the Err*
+// sentinels above, so callers can use errors.Is to tell problems apart.
+type SyntaxError struct {
+	Offset  int
+	Context string
+	Err     error
 }
 
-func decodeBencodeImpl(input string) (any, string, error) {
-	if unicode.IsDigit(rune(input[0])) {
-		var firstColonIndex int
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("bencode: %s at offset %d (%s)", e.Err, e.Offset, e.Context)
+}
 
-		for i := 0; i < len(input); i++ {
-			if input[i] == ':' {
-				firstColonIndex = i
-				break
-			}
-		}
+func (e *SyntaxError) Unwrap() error {
+	return e.Err
+}
+
+// Decoder reads bencoded values from a stream. It never reads past the end of
+// the value being decoded (beyond what its bufio.Reader buffers) and enforces
+// nesting and string length limits.
+type Decoder struct {
+	MaxDepth        int
+	MaxStringLength int
+
+	r      *bufio.Reader
+	offset int
+	depth  int
+	path   []string
+	record *bytes.Buffer
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Decoder{
+		MaxDepth:        defaultMaxDepth,
+		MaxStringLength: defaultMaxStringLength,
+		r:               br,
+	}
+}
+
+// Offset returns the number of bytes consumed so far.
+func (d *Decoder) Offset() int {
+	return d.offset
+}
+
+// Decode reads the next value. Byte strings are returned as string, integers
+// as int, lists as []any and dictionaries as map[string]any.
+func (d *Decoder) Decode() (any, error) {
+	d.depth = 0
+	d.path = d.path[:0]
+	return d.value()
+}
+
+// Decode parses a single bencoded value. Trailing data after the value is an
+// error.
+func Decode(data []byte) (any, error) {
+	value, n, err := DecodePrefix(data)
+	if err != nil {
+		return nil, err
+	}
+	if n != len(data) {
+		return nil, &SyntaxError{Offset: n, Context: "end of value", Err: ErrTrailingData}
+	}
+	return value, nil
+}
+
+// DecodePrefix parses the bencoded value at the start of data and reports how
+// many bytes it occupied, so that callers can deal with whatever follows.
+func DecodePrefix(data []byte) (any, int, error) {
+	d := NewDecoder(bytes.NewReader(data))
+	value, err := d.Decode()
+	return value, d.Offset(), err
+}
+
+func (d *Decoder) errorf(offset int, context string, err error) error {
+	return &SyntaxError{Offset: offset, Context: context, Err: err}
+}
 
-		lengthStr := input[:firstColonIndex]
-		length, err := strconv.Atoi(lengthStr)
+func (d *Decoder) readByte(context string) (byte, error) {
+	c, err := d.r.ReadByte()
+	if err == io.EOF {
+		return 0, d.errorf(d.offset, context, ErrUnexpectedEOF)
+	} else if err != nil {
+		return 0, err
+	}
+	d.offset++
+	if d.record != nil {
+		d.record.WriteByte(c)
+	}
+	return c, nil
+}
+
+func (d *Decoder) peekByte(context string) (byte, error) {
+	b, err := d.r.Peek(1)
+	if err == io.EOF {
+		return 0, d.errorf(d.offset, context, ErrUnexpectedEOF)
+	} else if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (d *Decoder) value() (any, error) {
+	c, err := d.peekByte("value")
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case c >= '0' && c <= '9':
+		return d.string()
+	case c == 'i':
+		return d.integer()
+	case c == 'l':
+		return d.list()
+	case c == 'd':
+		return d.dict()
+	default:
+		return nil, d.errorf(d.offset, fmt.Sprintf("value starting with %q", c), ErrUnexpectedByte)
+	}
+}
+
+// digits reads a run of ASCII digits (with an optional leading minus sign when
+// signed is set) up to and including the terminator byte.
+func (d *Decoder) digits(terminator byte, signed bool, context string) (string, error) {
+	var digits []byte
+	for {
+		c, err := d.readByte(context)
 		if err != nil {
-			return nil, "", err
+			return "", err
+		}
+		if c == terminator {
+			return string(digits), nil
 		}
+		if (c < '0' || c > '9') && !(signed && c == '-' && len(digits) == 0) {
+			return "", d.errorf(d.offset-1, context, ErrUnexpectedByte)
+		}
+		if len(digits) > 20 {
+			return "", d.errorf(d.offset-1, context, ErrBadInteger)
+		}
+		digits = append(digits, c)
+	}
+}
 
-		value := input[firstColonIndex+1 : firstColonIndex+1+length]
-		rem := input[len(lengthStr)+length+1:]
+func (d *Decoder) integer() (int, error) {
+	start := d.offset
+	d.readByte("integer")
 
-		return value, rem, nil
-	} else if input[0] == 'i' {
-		var firstEndIndex int
+	digits, err := d.digits('e', true, "integer")
+	if err != nil {
+		if errors.Is(err, ErrUnexpectedEOF) {
+			return 0, d.errorf(d.offset, fmt.Sprintf("integer starting at offset %d", start), ErrUnterminated)
+		}
+		return 0, err
+	}
 
-		for i := 0; i < len(input); i++ {
-			if input[i] == 'e' {
-				firstEndIndex = i
-				break
-			}
+	context := fmt.Sprintf("integer starting at offset %d", start)
+	unsigned := strings.TrimPrefix(digits, "-")
+	switch {
+	case unsigned == "":
+		return 0, d.errorf(start, context, ErrBadInteger)
+	case digits == "-0":
+		return 0, d.errorf(start, context, ErrNegativeZero)
+	case len(unsigned) > 1 && unsigned[0] == '0':
+		return 0, d.errorf(start, context, ErrLeadingZero)
+	}
+
+	value, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return 0, d.errorf(start, context, ErrBadInteger)
+	}
+	return int(value), nil
+}
+
+func (d *Decoder) string() (string, error) {
+	start := d.offset
+	context := fmt.Sprintf("string starting at offset %d", start)
+
+	digits, err := d.digits(':', false, "string length")
+	if err != nil {
+		return "", err
+	}
+	if len(digits) > 1 && digits[0] == '0' {
+		return "", d.errorf(start, context, ErrLeadingZero)
+	}
+	length, err := strconv.Atoi(digits)
+	if err != nil {
+		return "", d.errorf(start, context, ErrBadStringLength)
+	}
+	if length > d.MaxStringLength {
+		return "", d.errorf(start, context, ErrStringTooLong)
+	}
+
+	// Copy instead of allocating length bytes upfront, so a bogus length
+	// prefix on a short input cannot make us reserve MaxStringLength bytes.
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	if d.record != nil {
+		w = io.MultiWriter(&buf, d.record)
+	}
+	n, err := io.CopyN(w, d.r, int64(length))
+	d.offset += int(n)
+	if err == io.EOF {
+		return "", d.errorf(d.offset, context, ErrTruncatedString)
+	} else if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// raw reads the next value and returns its encoded bytes exactly as they
+// appeared in the input.
+func (d *Decoder) raw() ([]byte, error) {
+	prev := d.record
+	buf := new(bytes.Buffer)
+	d.record = buf
+	_, err := d.value()
+	d.record = prev
+	if prev != nil {
+		prev.Write(buf.Bytes())
+	}
+	return buf.Bytes(), err
+}
+
+func (d *Decoder) enter(context string) error {
+	d.depth++
+	if d.depth > d.MaxDepth {
+		return d.errorf(d.offset, context, ErrMaxDepth)
+	}
+	d.readByte(context)
+	return nil
+}
+
+// eachListItem consumes a list, calling fn to decode every item in turn.
+func (d *Decoder) eachListItem(fn func(index int) error) error {
+	context := fmt.Sprintf("list starting at offset %d", d.offset)
+	if err := d.enter(context); err != nil {
+		return err
+	}
+
+	for index := 0; ; index++ {
+		c, err := d.peekByte(context)
+		if errors.Is(err, ErrUnexpectedEOF) {
+			return d.errorf(d.offset, context, ErrUnterminated)
+		} else if err != nil {
+			return err
+		}
+		if c == 'e' {
+			d.readByte(context)
+			d.depth--
+			return nil
 		}
 
-		value, err := strconv.ParseInt(input[1:firstEndIndex], 10, 64)
+		d.path = append(d.path, strconv.Itoa(index))
+		err = fn(index)
+		d.path = d.path[:len(d.path)-1]
 		if err != nil {
-			return nil, "", err
+			return err
 		}
-		rem := input[firstEndIndex+1:]
+	}
+}
 
-		return int(value), rem, err
-	} else if input[0] == 'l' {
-		values := make([]any, 0)
-		rest := input[1:]
+// eachDictItem consumes a dictionary, calling fn with every key; fn must then
+// decode (or skip) the value that follows. Keys are not required to be sorted,
+// since plenty of torrents in the wild are not canonical, but duplicates are
+// rejected.
+func (d *Decoder) eachDictItem(fn func(key string) error) error {
+	context := fmt.Sprintf("dictionary starting at offset %d", d.offset)
+	if err := d.enter(context); err != nil {
+		return err
+	}
 
-		for len(rest) > 1 {
-			value, rem, err := decodeBencodeImpl(rest)
-			if err != nil {
-				return nil, rest, err
-			}
-			values = append(values, value)
-			if rem[0] == 'e' {
-				rest = rem[1:]
-				break
-			} else {
-				rest = rem
-			}
+	seen := make(map[string]bool)
+	for {
+		c, err := d.peekByte(context)
+		if errors.Is(err, ErrUnexpectedEOF) {
+			return d.errorf(d.offset, context, ErrUnterminated)
+		} else if err != nil {
+			return err
+		}
+		if c == 'e' {
+			d.readByte(context)
+			d.depth--
+			return nil
 		}
 
-		return values, rest, nil
-	} else if input[0] == 'd' {
-		dict := make(map[string]any, 0)
-		rest := input[1:]
+		keyOffset := d.offset
+		if c < '0' || c > '9' {
+			return d.errorf(keyOffset, context+", key", ErrUnexpectedByte)
+		}
+		key, err := d.string()
+		if err != nil {
+			return err
+		}
+		if seen[key] {
+			return d.errorf(keyOffset, fmt.Sprintf("%s, key %q", context, key), ErrDuplicateKey)
+		}
+		seen[key] = true
 
-		for len(rest) > 1 {
-			key, rem, err := decodeBencodeImpl(rest)
-			value, rem, err := decodeBencodeImpl(rem)
-			if err != nil {
-				return nil, rest, err
-			}
-			dict[key.(string)] = value
-			if rem[0] == 'e' {
-				rest = rem[1:]
-				break
-			} else {
-				rest = rem
-			}
+		d.path = append(d.path, key)
+		err = fn(key)
+		d.path = d.path[:len(d.path)-1]
+		if err != nil {
+			return err
 		}
+	}
+}
 
-		return dict, rest, nil
-	} else {
-		return nil, "", fmt.Errorf("Unknown input: %s", input)
+func (d *Decoder) list() ([]any, error) {
+	values := make([]any, 0)
+	err := d.eachListItem(func(int) error {
+		value, err := d.value()
+		values = append(values, value)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
+	return values, nil
 }
 
-type Metainfo struct {
-	Announce string
-	Info     Info
-	InfoHash []byte
+func (d *Decoder) dict() (map[string]any, error) {
+	dict := make(map[string]any)
+	err := d.eachDictItem(func(key string) error {
+		value, err := d.value()
+		dict[key] = value
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dict, nil
 }
 
-type Info struct {
-	Length      int
-	Name        string
-	PieceLength int
-	Pieces      [][]byte
+// Encode returns the bencoding of v. Both string and []byte are written as
+// byte strings, so binary data survives unchanged, and dictionary keys are
+// sorted, which makes Encode(Decode(data)) reproduce any canonical input.
+// Values other than the ones Decode produces (structs, typed maps and slices)
+// are handled by encodeReflect.
+func Encode(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encodeValue(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
-func parseMetainfo(r io.Reader) (Metainfo, error) {
-	input, err := io.ReadAll(r)
-	if err != nil {
-		return Metainfo{}, fmt.Errorf("unable to read metainfo file contents")
+func encodeValue(buf *bytes.Buffer, v any) error {
+	switch v := v.(type) {
+	case string:
+		buf.WriteString(strconv.Itoa(len(v)))
+		buf.WriteByte(':')
+		buf.WriteString(v)
+	case RawMessage:
+		if len(v) == 0 {
+			return fmt.Errorf("empty raw value")
+		}
+		buf.Write(v)
+	case []byte:
+		buf.WriteString(strconv.Itoa(len(v)))
+		buf.WriteByte(':')
+		buf.Write(v)
+	case int:
+		encodeInt(buf, int64(v))
+	case int8:
+		encodeInt(buf, int64(v))
+	case int16:
+		encodeInt(buf, int64(v))
+	case int32:
+		encodeInt(buf, int64(v))
+	case int64:
+		encodeInt(buf, v)
+	case uint8:
+		encodeInt(buf, int64(v))
+	case uint16:
+		encodeInt(buf, int64(v))
+	case uint32:
+		encodeInt(buf, int64(v))
+	case bool:
+		if v {
+			encodeInt(buf, 1)
+		} else {
+			encodeInt(buf, 0)
+		}
+	case []any:
+		buf.WriteByte('l')
+		for _, item := range v {
+			if err := encodeValue(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case []string:
+		buf.WriteByte('l')
+		for _, item := range v {
+			encodeValue(buf, item)
+		}
+		buf.WriteByte('e')
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+
+		buf.WriteByte('d')
+		for _, key := range keys {
+			encodeValue(buf, key)
+			if err := encodeValue(buf, v[key]); err != nil {
+				return fmt.Errorf("key %q: %w", key, err)
+			}
+		}
+		buf.WriteByte('e')
+	default:
+		return encodeReflect(buf, reflect.ValueOf(v))
 	}
+	return nil
+}
 
-	decoded, err := decodeBencode(string(input))
-	if err != nil {
-		log.Fatalln(err)
-	}
-
-	decodedMetainfo := decoded.(map[string]any)
-	decodedInfo := decodedMetainfo["info"].(map[string]any)
-	announce := decodedMetainfo["announce"].(string)
-	length := decodedInfo["length"].(int)
-	name := decodedInfo["name"].(string)
-	pieceLength := decodedInfo["piece length"].(int)
-	rawPieces := []byte(decodedInfo["pieces"].(string))
-	piecesCount := len(rawPieces) / 20
-	pieces := make([][]byte, 0, piecesCount)
-	for i := 0; i < piecesCount; i++ {
-		pieces = append(pieces, rawPieces[i*20:(i+1)*20])
-	}
-	out := new(strings.Builder)
-	bencode.Marshal(out, decodedInfo)
-	infoHash := sha1.Sum([]byte(out.String()))
-
-	return Metainfo{
-		Announce: announce,
-		Info: Info{
-			Length:      length,
-			Name:        name,
-			PieceLength: pieceLength,
-			Pieces:      pieces,
-		},
-		InfoHash: infoHash[:],
-	}, nil
+func encodeInt(buf *bytes.Buffer, v int64) {
+	buf.WriteByte('i')
+	buf.WriteString(strconv.FormatInt(v, 10))
+	buf.WriteByte('e')
 }
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// RawMessage is an encoded bencode value. Unmarshal stores the exact input
+// bytes in it and Marshal writes it back verbatim, which is how the info
+// dictionary keeps the bytes its hash is computed from.
+type RawMessage []byte
+
+// Marshaler is implemented by types that encode themselves.
+type Marshaler interface {
+	MarshalBencode() ([]byte, error)
+}
+
+// Unmarshaler is implemented by types that decode themselves. The data passed
+// to UnmarshalBencode is a single, already validated bencoded value.
+type Unmarshaler interface {
+	UnmarshalBencode(data []byte) error
+}
+
+var (
+	rawMessageType  = reflect.TypeFor[RawMessage]()
+	marshalerType   = reflect.TypeFor[Marshaler]()
+	unmarshalerType = reflect.TypeFor[Unmarshaler]()
+)
+
+// UnmarshalTypeError describes a bencode value that does not fit the Go value
+// it was decoded into.
+type UnmarshalTypeError struct {
+	Value  string
+	Type   reflect.Type
+	Field  string
+	Offset int
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("bencode: cannot unmarshal %s into value of type %s at offset %d", e.Value, e.Type, e.Offset)
+	}
+	return fmt.Sprintf("bencode: cannot unmarshal %s into %q of type %s at offset %d", e.Value, e.Field, e.Type, e.Offset)
+}
+
+// MissingFieldError is returned when a dictionary lacks a key whose struct
+// field is tagged as required.
+type MissingFieldError struct {
+	Field string
+	Type  reflect.Type
+}
+
+func (e *MissingFieldError) Error() string {
+	return fmt.Sprintf("bencode: missing required key %q for %s", e.Field, e.Type)
+}
+
+// Marshal returns the bencoding of v. Struct fields are encoded as dictionary
+// entries named by their `bencode:"key"` tag (or the field name when untagged);
+// the "omitempty" option skips zero values and "-" skips the field entirely.
+func Marshal(v any) ([]byte, error) {
+	return Encode(v)
+}
+
+// Unmarshal decodes data into the value pointed to by v. Struct fields are
+// matched by their `bencode:"key"` tag, unknown keys are ignored, and fields
+// tagged "required" must be present.
+func Unmarshal(data []byte, v any) error {
+	d := NewDecoder(bytes.NewReader(data))
+	if err := d.DecodeInto(v); err != nil {
+		return err
+	}
+	if d.Offset() != len(data) {
+		return &SyntaxError{Offset: d.Offset(), Context: "end of value", Err: ErrTrailingData}
+	}
+	return nil
+}
+
+// DecodeInto reads the next value into the value pointed to by v, following
+// the same rules as Unmarshal.
+func (d *Decoder) DecodeInto(v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("bencode: DecodeInto requires a non-nil pointer, got %T", v)
+	}
+	d.depth = 0
+	d.path = d.path[:0]
+	return d.decodeInto(rv.Elem())
+}
+
+func (d *Decoder) typeError(value string, t reflect.Type, offset int) error {
+	return &UnmarshalTypeError{
+		Value:  value,
+		Type:   t,
+		Field:  strings.Join(d.path, "."),
+		Offset: offset,
+	}
+}
+
+func (d *Decoder) decodeInto(rv reflect.Value) error {
+	if rv.Type() == rawMessageType {
+		raw, err := d.raw()
+		if err != nil {
+			return err
+		}
+		rv.SetBytes(raw)
+		return nil
+	}
+	if rv.Kind() != reflect.Pointer && rv.CanAddr() && rv.Addr().Type().Implements(unmarshalerType) {
+		offset := d.offset
+		raw, err := d.raw()
+		if err != nil {
+			return err
+		}
+		if err := rv.Addr().Interface().(Unmarshaler).UnmarshalBencode(raw); err != nil {
+			return fmt.Errorf("bencode: %q at offset %d: %w", strings.Join(d.path, "."), offset, err)
+		}
+		return nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Pointer:
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		return d.decodeInto(rv.Elem())
+	case reflect.Interface:
+		if rv.NumMethod() != 0 {
+			return d.typeError("value", rv.Type(), d.offset)
+		}
+		value, err := d.value()
+		if err != nil {
+			return err
+		}
+		rv.Set(reflect.ValueOf(value))
+		return nil
+	}
+
+	offset := d.offset
+	c, err := d.peekByte("value")
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case c >= '0' && c <= '9':
+		s, err := d.string()
+		if err != nil {
+			return err
+		}
+		return d.setString(rv, s, offset)
+	case c == 'i':
+		n, err := d.integer()
+		if err != nil {
+			return err
+		}
+		return d.setInt(rv, n, offset)
+	case c == 'l':
+		return d.decodeList(rv, offset)
+	case c == 'd':
+		return d.decodeDict(rv, offset)
+	default:
+		return d.errorf(offset, fmt.Sprintf("value starting with %q", c), ErrUnexpectedByte)
+	}
+}
+
+func (d *Decoder) setString(rv reflect.Value, s string, offset int) error {
+	switch {
+	case rv.Kind() == reflect.String:
+		rv.SetString(s)
+	case rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() == reflect.Uint8:
+		rv.SetBytes([]byte(s))
+	case rv.Kind() == reflect.Array && rv.Type().Elem().Kind() == reflect.Uint8:
+		if len(s) != rv.Len() {
+			return d.typeError(fmt.Sprintf("string of length %d", len(s)), rv.Type(), offset)
+		}
+		reflect.Copy(rv, reflect.ValueOf([]byte(s)))
+	default:
+		return d.typeError("string", rv.Type(), offset)
+	}
+	return nil
+}
+
+func (d *Decoder) setInt(rv reflect.Value, n int, offset int) error {
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if rv.OverflowInt(int64(n)) {
+			return d.typeError("integer "+strconv.Itoa(n), rv.Type(), offset)
+		}
+		rv.SetInt(int64(n))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if n < 0 || rv.OverflowUint(uint64(n)) {
+			return d.typeError("integer "+strconv.Itoa(n), rv.Type(), offset)
+		}
+		rv.SetUint(uint64(n))
+	case reflect.Bool:
+		rv.SetBool(n != 0)
+	default:
+		return d.typeError("integer", rv.Type(), offset)
+	}
+	return nil
+}
+
+func (d *Decoder) decodeList(rv reflect.Value, offset int) error {
+	switch rv.Kind() {
+	case reflect.Slice:
+		rv.Set(reflect.MakeSlice(rv.Type(), 0, 0))
+		return d.eachListItem(func(int) error {
+			elem := reflect.New(rv.Type().Elem()).Elem()
+			if err := d.decodeInto(elem); err != nil {
+				return err
+			}
+			rv.Set(reflect.Append(rv, elem))
+			return nil
+		})
+	case reflect.Array:
+		err := d.eachListItem(func(index int) error {
+			if index >= rv.Len() {
+				return d.typeError("list longer than "+strconv.Itoa(rv.Len()), rv.Type(), offset)
+			}
+			return d.decodeInto(rv.Index(index))
+		})
+		return err
+	default:
+		return d.typeError("list", rv.Type(), offset)
+	}
+}
+
+func (d *Decoder) decodeDict(rv reflect.Value, offset int) error {
+	switch rv.Kind() {
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return d.typeError("dictionary", rv.Type(), offset)
+		}
+		if rv.IsNil() {
+			rv.Set(reflect.MakeMap(rv.Type()))
+		}
+		return d.eachDictItem(func(key string) error {
+			elem := reflect.New(rv.Type().Elem()).Elem()
+			if err := d.decodeInto(elem); err != nil {
+				return err
+			}
+			rv.SetMapIndex(reflect.ValueOf(key).Convert(rv.Type().Key()), elem)
+			return nil
+		})
+	case reflect.Struct:
+		fields := structFields(rv.Type())
+		seen := make([]bool, len(fields))
+		err := d.eachDictItem(func(key string) error {
+			i := slices.IndexFunc(fields, func(f field) bool { return f.name == key })
+			if i < 0 {
+				_, err := d.value()
+				return err
+			}
+			seen[i] = true
+			return d.decodeInto(rv.Field(fields[i].index))
+		})
+		if err != nil {
+			return err
+		}
+		for i, f := range fields {
+			if f.required && !seen[i] {
+				return &MissingFieldError{Field: strings.Join(append(d.path, f.name), "."), Type: rv.Type()}
+			}
+		}
+		return nil
+	default:
+		return d.typeError("dictionary", rv.Type(), offset)
+	}
+}
+
+type field struct {
+	name      string
+	index     int
+	omitEmpty bool
+	required  bool
+}
+
+// structFields lists the bencoded fields of a struct type sorted by key, which
+// is the order Marshal has to write them in.
+func structFields(t reflect.Type) []field {
+	var fields []field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		tag := sf.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+
+		name, options, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = sf.Name
+		}
+		f := field{name: name, index: i}
+		for _, option := range strings.Split(options, ",") {
+			switch option {
+			case "omitempty":
+				f.omitEmpty = true
+			case "required":
+				f.required = true
+			}
+		}
+		fields = append(fields, f)
+	}
+	slices.SortFunc(fields, func(a, b field) int { return strings.Compare(a.name, b.name) })
+	return fields
+}
+
+func isEmptyValue(rv reflect.Value) bool {
+	switch rv.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return rv.Len() == 0
+	default:
+		return rv.IsZero()
+	}
+}
+
+func encodeReflect(buf *bytes.Buffer, rv reflect.Value) error {
+	if !rv.IsValid() {
+		return fmt.Errorf("unable to encode nil value")
+	}
+	if rv.Type() == rawMessageType {
+		return encodeValue(buf, RawMessage(rv.Bytes()))
+	}
+	if rv.Kind() != reflect.Pointer && rv.Type().Implements(marshalerType) {
+		encoded, err := rv.Interface().(Marshaler).MarshalBencode()
+		if err != nil {
+			return err
+		}
+		buf.Write(encoded)
+		return nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if rv.IsNil() {
+			return fmt.Errorf("unable to encode nil %s", rv.Type())
+		}
+		return encodeReflect(buf, rv.Elem())
+	case reflect.String:
+		return encodeValue(buf, rv.String())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		encodeInt(buf, rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		buf.WriteByte('i')
+		buf.WriteString(strconv.FormatUint(rv.Uint(), 10))
+		buf.WriteByte('e')
+	case reflect.Bool:
+		return encodeValue(buf, rv.Bool())
+	case reflect.Slice, reflect.Array:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			data := make([]byte, rv.Len())
+			reflect.Copy(reflect.ValueOf(data), rv)
+			return encodeValue(buf, data)
+		}
+		buf.WriteByte('l')
+		for i := 0; i < rv.Len(); i++ {
+			if err := encodeReflect(buf, rv.Index(i)); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("unable to encode map with %s keys", rv.Type().Key())
+		}
+		keys := rv.MapKeys()
+		slices.SortFunc(keys, func(a, b reflect.Value) int { return strings.Compare(a.String(), b.String()) })
+
+		buf.WriteByte('d')
+		for _, key := range keys {
+			encodeValue(buf, key.String())
+			if err := encodeReflect(buf, rv.MapIndex(key)); err != nil {
+				return fmt.Errorf("key %q: %w", key.String(), err)
+			}
+		}
+		buf.WriteByte('e')
+	case reflect.Struct:
+		buf.WriteByte('d')
+		for _, f := range structFields(rv.Type()) {
+			value := rv.Field(f.index)
+			if f.omitEmpty && isEmptyValue(value) {
+				continue
+			}
+			encodeValue(buf, f.name)
+			if err := encodeReflect(buf, value); err != nil {
+				return fmt.Errorf("key %q: %w", f.name, err)
+			}
+		}
+		buf.WriteByte('e')
+	default:
+		return fmt.Errorf("unable to encode value of type %s", rv.Type())
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestBencodeRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"empty string", "0:"},
+		{"string", "5:hello"},
+		{"binary string", "4:\x00\xff\x80\n"},
+		{"zero", "i0e"},
+		{"negative", "i-42e"},
+		{"large integer", "i9223372036854775807e"},
+		{"empty list", "le"},
+		{"list", "l5:helloi52ee"},
+		{"nested list", "lli1eeli2ei3eee"},
+		{"empty dict", "de"},
+		{"dict", "d3:bar4:spam3:fooi42ee"},
+		{"binary keys", "d1:\x001:a1:\xff1:be"},
+		{"nested dict", "d4:infod6:lengthi10e4:name4:filee5:otherlee"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, err := Decode([]byte(tt.input))
+			if err != nil {
+				t.Fatalf("Decode(%q): %v", tt.input, err)
+			}
+			encoded, err := Encode(value)
+			if err != nil {
+				t.Fatalf("Encode(%#v): %v", value, err)
+			}
+			if !bytes.Equal(encoded, []byte(tt.input)) {
+				t.Errorf("round trip of %q gave %q", tt.input, encoded)
+			}
+		})
+	}
+}
+
+func TestBencodeSortsKeys(t *testing.T) {
+	value, err := Decode([]byte("d3:fooi1e3:bari2ee"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := Encode(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "d3:bari2e3:fooi1ee"; string(encoded) != want {
+		t.Errorf("got %q, want %q", encoded, want)
+	}
+}
+
+func TestBencodeDecodeErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		err   error
+	}{
+		{"", ErrUnexpectedEOF},
+		{"i42", ErrUnterminated},
+		{"i042e", ErrLeadingZero},
+		{"i-0e", ErrNegativeZero},
+		{"ie", ErrBadInteger},
+		{"5:abc", ErrTruncatedString},
+		{"l5:hello", ErrUnterminated},
+		{"d1:ai1e1:ai2ee", ErrDuplicateKey},
+		{"di1ei2ee", ErrUnexpectedByte},
+		{"i1ei2e", ErrTrailingData},
+		{"x", ErrUnexpectedByte},
+	}
+	for _, tt := range tests {
+		_, err := Decode([]byte(tt.input))
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) || !errors.Is(err, tt.err) {
+			t.Errorf("Decode(%q) = %v, want %v", tt.input, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// Bitfield is a set of piece indexes as sent in bitfield messages: the high
+// bit of the first byte is piece 0.
+type Bitfield []byte
+
+func newBitfield(pieceCount int) Bitfield {
+	return make(Bitfield, (pieceCount+7)/8)
+}
+
+// parseBitfield validates a bitfield received for a torrent of pieceCount
+// pieces: it must have exactly the right length and no spare bits set.
+func parseBitfield(data []byte, pieceCount int) (Bitfield, error) {
+	if len(data) != (pieceCount+7)/8 {
+		return nil, fmt.Errorf("invalid bitfield of %d bytes for %d pieces", len(data), pieceCount)
+	}
+	if spare := pieceCount % 8; spare != 0 && data[len(data)-1]&(0xff>>spare) != 0 {
+		return nil, errors.New("invalid bitfield: spare bits set")
+	}
+	return Bitfield(append([]byte(nil), data...)), nil
+}
+
+func (b Bitfield) Has(index int) bool {
+	if index < 0 || index/8 >= len(b) {
+		return false
+	}
+	return b[index/8]&(0x80>>(index%8)) != 0
+}
+
+func (b Bitfield) Set(index int) {
+	b[index/8] |= 0x80 >> (index % 8)
+}
+
+func (b Bitfield) Count() int {
+	var count int
+	for _, v := range b {
+		count += bits.OnesCount8(v)
+	}
+	return count
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/sha1"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	minPieceLength    = 16 * 1024
+	maxPieceLength    = 16 * 1024 * 1024
+	targetPieceCount  = 1500
+	defaultCreatedBy  = "mybittorrent"
+	torrentFileSuffix = ".torrent"
+)
+
+// stringList is a flag.Value collecting every occurrence of a repeated flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func executeCreate(args []string) {
+	flags := flag.NewFlagSet("create", flag.ExitOnError)
+	output := flags.String("o", "", "output file (default: <name>.torrent)")
+	pieceLength := flags.Int("piece-length", 0, "piece length in bytes, a power of two (default: chosen from the content size)")
+	announce := flags.String("announce", "", "primary tracker URL")
+	var announceTiers, webSeeds stringList
+	flags.Var(&announceTiers, "announce-list", "comma separated tracker URLs forming one tier; repeat for more tiers")
+	comment := flags.String("comment", "", "free-form comment")
+	createdBy := flags.String("created-by", defaultCreatedBy, "name of the program creating the torrent")
+	noDate := flags.Bool("no-date", false, "omit the creation date")
+	private := flags.Bool("private", false, "set the private flag")
+	flags.Var(&webSeeds, "web-seed", "web seed URL (BEP 19); may be repeated")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: create [options] <file_or_directory>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	info, root, err := buildInfo(flags.Arg(0))
+	if err != nil {
+		log.Fatalln("unable to read content", err)
+	}
+	if info.TotalLength() == 0 {
+		log.Fatalln("cannot create a torrent for empty content")
+	}
+	if *pieceLength == 0 {
+		info.PieceLength = choosePieceLength(info.TotalLength())
+	} else if *pieceLength < minPieceLength || *pieceLength&(*pieceLength-1) != 0 {
+		log.Fatalf("piece length must be a power of two of at least %d\n", minPieceLength)
+	} else {
+		info.PieceLength = *pieceLength
+	}
+	if *private {
+		info.Private = 1
+	}
+
+	storage, err := newStorage(root, &info)
+	if err != nil {
+		log.Fatalln("unable to lay out files", err)
+	}
+	info.Pieces, err = hashPieces(storage)
+	if err != nil {
+		log.Fatalln("unable to hash content", err)
+	}
+
+	metainfo := Metainfo{
+		Announce:  *announce,
+		Comment:   *comment,
+		CreatedBy: *createdBy,
+		URLList:   webSeeds,
+	}
+	for _, tier := range announceTiers {
+		metainfo.AnnounceList = append(metainfo.AnnounceList, strings.Split(tier, ","))
+	}
+	if metainfo.Announce == "" && len(metainfo.AnnounceList) > 0 {
+		metainfo.Announce = metainfo.AnnounceList[0][0]
+	}
+	if !*noDate {
+		metainfo.CreationDate = time.Now().Unix()
+	}
+
+	metainfo.RawInfo, err = Marshal(info)
+	if err != nil {
+		log.Fatalln("unable to encode info dictionary", err)
+	}
+	encoded, err := Marshal(metainfo)
+	if err != nil {
+		log.Fatalln("unable to encode metainfo", err)
+	}
+
+	path := *output
+	if path == "" {
+		path = info.Name + torrentFileSuffix
+	}
+	if err := os.WriteFile(path, encoded, 0o644); err != nil {
+		log.Fatalln("unable to write torrent file", err)
+	}
+
+	infoHash := sha1.Sum(metainfo.RawInfo)
+	fmt.Printf("Info Hash: %x\n", infoHash)
+	fmt.Printf("Torrent written to %s\n", path)
+}
+
+// buildInfo describes the file or directory at path, returning the info
+// dictionary without piece hashes and the root newStorage needs to find the
+// files again.
+func buildInfo(path string) (Info, string, error) {
+	// The absolute path gives "." and ".." a real base name.
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return Info{}, "", err
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return Info{}, "", err
+	}
+
+	// An empty, non-nil Pieces marks this as a v1 torrent until the hashes
+	// are filled in.
+	info := Info{Name: filepath.Base(path), Pieces: make([]byte, 0)}
+	if !stat.IsDir() {
+		info.Length = int(stat.Size())
+		return info, path, nil
+	}
+
+	info.Files = make([]FileInfo, 0)
+	err = filepath.WalkDir(path, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		fileStat, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(path, filePath)
+		if err != nil {
+			return err
+		}
+		info.Files = append(info.Files, FileInfo{
+			Length: int(fileStat.Size()),
+			Path:   strings.Split(filepath.ToSlash(rel), "/"),
+		})
+		return nil
+	})
+	if err != nil {
+		return Info{}, "", err
+	}
+	if len(info.Files) == 0 {
+		return Info{}, "", fmt.Errorf("%s contains no files", path)
+	}
+	return info, filepath.Dir(path), nil
+}
+
+// choosePieceLength picks the smallest power of two that keeps the number of
+// pieces around targetPieceCount.
+func choosePieceLength(totalLength int) int {
+	pieceLength := minPieceLength
+	for pieceLength < maxPieceLength && totalLength/pieceLength > targetPieceCount {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// hashPieces computes the concatenated SHA-1 piece hashes, spreading the work
+// over all available cores.
+func hashPieces(storage *Storage) ([]byte, error) {
+	pieceCount := storage.PieceCount()
+	pieces := make([]byte, pieceCount*sha1.Size)
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for range runtime.NumCPU() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				data, err := storage.ReadPiece(index)
+				if err != nil {
+					once.Do(func() { firstErr = err })
+					continue
+				}
+				sum := sha1.Sum(data)
+				copy(pieces[index*sha1.Size:], sum[:])
+			}
+		}()
+	}
+
+	for index := 0; index < pieceCount; index++ {
+		indexes <- index
+	}
+	close(indexes)
+	wg.Wait()
+
+	return pieces, firstErr
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuildInfoNamesRelativeDirectories(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "content")
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sub", "a.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(filepath.Join(dir, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	for path, want := range map[string]string{".": "sub", "..": "content", "./a.txt": "a.txt"} {
+		info, _, err := buildInfo(path)
+		if err != nil {
+			t.Fatalf("buildInfo(%q): %v", path, err)
+		}
+		if info.Name != want {
+			t.Errorf("buildInfo(%q) named the torrent %q, want %q", path, info.Name, want)
+		}
+	}
+}
@@ -1,21 +1,200 @@
 package main
 
 import (
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
 )
 
+// treeBinaryPreview is how many bytes of a binary string the tree view shows
+// before eliding the rest.
+const treeBinaryPreview = 32
+
+// jsonBinaryMarker starts the JSON keys that stand for binary data. Real
+// dictionary keys starting with it are escaped by doubling it, so the JSON
+// output can always be mapped back to the bencoded value.
+const jsonBinaryMarker = "$"
+
 func executeDecode(args []string) {
-	if len(args) < 1 {
-		log.Fatalln("usage: decode <value>")
+	flags := flag.NewFlagSet("decode", flag.ExitOnError)
+	format := flags.String("format", "json", "output format: json, tree or bencode")
+	binary := flags.String("binary", "hex", "encoding for non UTF-8 strings: hex or base64")
+	file := flags.String("file", "", "read the value from a file instead of an argument")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: decode [-format json|tree|bencode] [-binary hex|base64] [-file <path> | - | <value>]")
+		fmt.Fprintln(flags.Output(), `
+In JSON output, strings that are not valid UTF-8 become {"$hex": "..."}
+(or {"$base64": "..."}) and such dictionary keys become "$hex:...".
+Dictionary keys that start with "$" are written with a second "$".`)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	var encodeBinary func([]byte) string
+	switch *binary {
+	case "hex":
+		encodeBinary = hex.EncodeToString
+	case "base64":
+		encodeBinary = base64.StdEncoding.EncodeToString
+	default:
+		log.Fatalf("unknown binary encoding: %s\n", *binary)
 	}
 
-	decoded, err := decodeBencode(args[0])
+	var decoded any
+	var err error
+	switch {
+	case *file != "":
+		f, openErr := os.Open(*file)
+		if openErr != nil {
+			log.Fatalln("error opening file", openErr)
+		}
+		defer f.Close()
+		decoded, err = decodeStream(f)
+	case flags.Arg(0) == "-":
+		decoded, err = decodeStream(os.Stdin)
+	case flags.NArg() == 1:
+		decoded, err = Decode([]byte(flags.Arg(0)))
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	jsonOutput, _ := json.Marshal(decoded)
-	fmt.Println(string(jsonOutput))
+	switch *format {
+	case "json":
+		jsonOutput, err := json.Marshal(toJSONValue(decoded, *binary, encodeBinary))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Println(string(jsonOutput))
+	case "tree":
+		var out strings.Builder
+		writeTree(&out, decoded, 0, encodeBinary)
+		fmt.Print(out.String())
+	case "bencode":
+		encoded, err := Encode(decoded)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		os.Stdout.Write(encoded)
+	default:
+		log.Fatalf("unknown output format: %s\n", *format)
+	}
+}
+
+// decodeStream decodes a single value from r and rejects anything after it.
+func decodeStream(r io.Reader) (any, error) {
+	decoder := NewDecoder(r)
+	decoded, err := decoder.Decode()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := decoder.peekByte("end of value"); err == nil {
+		return nil, &SyntaxError{Offset: decoder.Offset(), Context: "end of value", Err: ErrTrailingData}
+	}
+	return decoded, nil
+}
+
+// toJSONValue converts a decoded value into something encoding/json renders
+// faithfully. Strings that are not valid UTF-8 become {"$hex": "..."} (or
+// "$base64") objects; dictionary keys, which have to stay JSON strings, get a
+// "$hex:" style prefix instead. Keys of real dictionaries that start with "$"
+// get a second one, so neither form can be mistaken for decoded data.
+func toJSONValue(v any, encoding string, encodeBinary func([]byte) string) any {
+	switch v := v.(type) {
+	case string:
+		if utf8.ValidString(v) {
+			return v
+		}
+		return map[string]string{jsonBinaryMarker + encoding: encodeBinary([]byte(v))}
+	case []any:
+		values := make([]any, 0, len(v))
+		for _, item := range v {
+			values = append(values, toJSONValue(item, encoding, encodeBinary))
+		}
+		return values
+	case map[string]any:
+		dict := make(map[string]any, len(v))
+		for key, item := range v {
+			switch {
+			case !utf8.ValidString(key):
+				key = jsonBinaryMarker + encoding + ":" + encodeBinary([]byte(key))
+			case strings.HasPrefix(key, jsonBinaryMarker):
+				key = jsonBinaryMarker + key
+			}
+			dict[key] = toJSONValue(item, encoding, encodeBinary)
+		}
+		return dict
+	default:
+		return v
+	}
+}
+
+func formatTreeString(s string, encodeBinary func([]byte) string) string {
+	if utf8.ValidString(s) {
+		return strconv.Quote(s)
+	}
+	if len(s) <= treeBinaryPreview {
+		return fmt.Sprintf("<%d bytes> %s", len(s), encodeBinary([]byte(s)))
+	}
+	return fmt.Sprintf("<%d bytes> %s...", len(s), encodeBinary([]byte(s[:treeBinaryPreview])))
+}
+
+func writeTree(out *strings.Builder, v any, depth int, encodeBinary func([]byte) string) {
+	indent := strings.Repeat("  ", depth)
+
+	switch v := v.(type) {
+	case []any:
+		for _, item := range v {
+			out.WriteString(indent + "-")
+			writeTreeChild(out, item, depth, encodeBinary)
+		}
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+
+		for _, key := range keys {
+			label := key
+			if !utf8.ValidString(key) {
+				label = formatTreeString(key, encodeBinary)
+			}
+			out.WriteString(indent + label + ":")
+			writeTreeChild(out, v[key], depth, encodeBinary)
+		}
+	case string:
+		out.WriteString(indent + formatTreeString(v, encodeBinary) + "\n")
+	default:
+		out.WriteString(fmt.Sprintf("%s%v\n", indent, v))
+	}
+}
+
+// writeTreeChild finishes a "key:" or "-" line, either with a scalar on the
+// same line or with a nested, indented block.
+func writeTreeChild(out *strings.Builder, v any, depth int, encodeBinary func([]byte) string) {
+	switch v := v.(type) {
+	case []any:
+		out.WriteString(fmt.Sprintf(" (list, %d items)\n", len(v)))
+		writeTree(out, v, depth+1, encodeBinary)
+	case map[string]any:
+		out.WriteString(fmt.Sprintf(" (dictionary, %d keys)\n", len(v)))
+		writeTree(out, v, depth+1, encodeBinary)
+	case string:
+		out.WriteString(" " + formatTreeString(v, encodeBinary) + "\n")
+	default:
+		out.WriteString(fmt.Sprintf(" %v\n", v))
+	}
 }
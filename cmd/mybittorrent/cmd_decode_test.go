@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+)
+
+func TestToJSONValueMarksBinaryData(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"d3:foo3:bare", `{"foo":"bar"}`},
+		{"2:\xff\xfe", `{"$hex":"fffe"}`},
+		{"d3:hex4:fffee", `{"hex":"fffe"}`},
+		{"d4:$hex4:fffee", `{"$$hex":"fffe"}`},
+		{"d2:\xff\xfei1ee", `{"$hex:fffe":1}`},
+		{"d9:$hex:ffffi1ee", `{"$$hex:ffff":1}`},
+	}
+	for _, tt := range tests {
+		decoded, err := Decode([]byte(tt.input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := json.Marshal(toJSONValue(decoded, "hex", hex.EncodeToString))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.input, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+)
+
+func executeDHTPut(args []string) {
+	flags := flag.NewFlagSet("dht-put", flag.ExitOnError)
+	keyFile := flags.String("key", "", "file holding the hex ed25519 seed of a mutable item; created if missing (default: store an immutable item)")
+	salt := flags.String("salt", "", "salt distinguishing several mutable items under one key")
+	seq := flags.Int64("seq", -1, "sequence number of a mutable item (default: one more than the stored item)")
+	cas := flags.Int64("cas", -1, "only replace the stored item if it has this sequence number (default: the item read when -seq is not set)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: dht-put [-key <file> [-salt <salt>] [-seq <n>] [-cas <n>]] <value>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	value := flags.Arg(0)
+
+	d, err := joinDHT()
+	if err != nil {
+		log.Fatalln("unable to join the dht", err)
+	}
+	defer d.Close()
+
+	if *keyFile == "" {
+		target, err := d.PutImmutable(value)
+		if err != nil {
+			log.Fatalln("unable to store item", err)
+		}
+		fmt.Printf("Target: %x\n", target)
+		return
+	}
+
+	privateKey, err := loadOrCreateKey(*keyFile)
+	if err != nil {
+		log.Fatalln("unable to load key", err)
+	}
+	publicKey := privateKey.Public().(ed25519.PublicKey)
+
+	var casSeq *int64
+	if *cas >= 0 {
+		casSeq = cas
+	}
+	if *seq < 0 {
+		*seq = 0
+		if current, err := d.GetMutable(publicKey, []byte(*salt)); err == nil {
+			*seq = current.Seq + 1
+			if casSeq == nil {
+				casSeq = &current.Seq
+			}
+		}
+	}
+
+	item, err := newMutableItem(privateKey, []byte(*salt), *seq, value)
+	if err != nil {
+		log.Fatalln("unable to sign item", err)
+	}
+	if err := d.PutMutable(item, casSeq); err != nil {
+		log.Fatalln("unable to store item", err)
+	}
+	fmt.Printf("Target: %x\n", item.Target())
+	fmt.Printf("Public Key: %x\n", publicKey)
+	fmt.Printf("Seq: %d\n", item.Seq)
+}
+
+func executeDHTGet(args []string) {
+	flags := flag.NewFlagSet("dht-get", flag.ExitOnError)
+	key := flags.String("key", "", "hex public key of a mutable item")
+	salt := flags.String("salt", "", "salt of the mutable item")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: dht-get <target> | dht-get -key <public_key> [-salt <salt>]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if (*key == "") == (flags.NArg() == 0) {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	d, err := joinDHT()
+	if err != nil {
+		log.Fatalln("unable to join the dht", err)
+	}
+	defer d.Close()
+
+	var value RawMessage
+	if *key == "" {
+		target, err := hex.DecodeString(flags.Arg(0))
+		if err != nil || len(target) != len(NodeID{}) {
+			log.Fatalln("invalid target", flags.Arg(0))
+		}
+		value, err = d.GetImmutable(NodeID(target))
+		if err != nil {
+			log.Fatalln("unable to get item", err)
+		}
+	} else {
+		publicKey, err := hex.DecodeString(*key)
+		if err != nil || len(publicKey) != ed25519.PublicKeySize {
+			log.Fatalln("invalid public key", *key)
+		}
+		item, err := d.GetMutable(publicKey, []byte(*salt))
+		if err != nil {
+			log.Fatalln("unable to get item", err)
+		}
+		value = item.Value
+		fmt.Printf("Seq: %d\n", item.Seq)
+	}
+
+	decoded, err := Decode(value)
+	if err != nil {
+		log.Fatalln("unable to decode item", err)
+	}
+	encoded, err := json.Marshal(toJSONValue(decoded, "hex", hex.EncodeToString))
+	if err != nil {
+		log.Fatalln("unable to encode item", err)
+	}
+	fmt.Printf("Value: %s\n", encoded)
+}
+
+// loadOrCreateKey reads an ed25519 seed stored as hex in path, generating and
+// saving a new one if the file does not exist yet.
+func loadOrCreateKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		seed := make([]byte, ed25519.SeedSize)
+		rand.Read(seed)
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(seed)+"\n"), 0o600); err != nil {
+			return nil, err
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s does not hold a hex ed25519 seed", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
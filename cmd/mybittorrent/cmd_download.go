@@ -1,17 +1,27 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"os"
 )
 
 func executeDownload(args []string) {
-	if len(args) < 3 {
-		log.Fatalln("usage: download -o <out_dir> <torrent_file>")
+	flags := flag.NewFlagSet("download", flag.ExitOnError)
+	output := flags.String("o", "", "path to write the downloaded file to")
+	maxPeers := flags.Int("max-peers", defaultMaxPeers, "number of peers to download from at once")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: download -o <out_dir> [options] <torrent_file>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *output == "" || flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
 	}
 
-	f, err := os.Open(args[2])
+	f, err := os.Open(flags.Arg(0))
 	if err != nil {
 		log.Fatalln("error opening metainfo file", err)
 	}
@@ -22,60 +32,38 @@ func executeDownload(args []string) {
 		log.Fatalln("error parsing metainfo file", err)
 	}
 
-	peers, err := getPeersFromMetainfo(&metainfo)
+	session := newTrackerSession(&metainfo)
+	peers, err := session.Start()
+	peers, err = withDHTFallback(metainfo.InfoHash, peers, err)
 	if err != nil {
 		log.Fatalln("unable to get peers from metainfo", err)
 	}
-	if len(peers) == 0 {
-		log.Fatalln("no peers available")
-	}
-
-	client, err := NewTCPClient(peers[0])
-	if err != nil {
-		log.Fatalln("unable to create tcp client")
-	}
-
-	handshakePacket := createHandshakePacket(metainfo.InfoHash, false)
-	_, err = client.Write(handshakePacket)
-	if err != nil {
-		log.Fatalln("unable to write all data to socket")
-	}
 
-	receivedLen, receivedBytes, err := client.Receive(1024)
+	storage, err := newStorage(*output, &metainfo.Info)
 	if err != nil {
-		log.Fatalln("unable to read data from socket")
+		log.Fatalln("unable to lay out files", err)
 	}
-	fmt.Printf("Peer ID: %x\n", receivedBytes[receivedLen-20:])
 
-	receivedLen, receivedBytes, err = client.Receive(1024)
+	verifier, err := newPieceVerifier(&metainfo.Info, metainfo.PieceLayers)
 	if err != nil {
-		log.Fatalln("unable to read data from socket")
+		log.Fatalln("unable to verify pieces", err)
 	}
 
-	interestedPacket := PeerMessage{
-		length:  1,
-		id:      2,
-		payload: make([]byte, 0),
-	}
-	_, err = client.Write(interestedPacket.serialize())
-	if err != nil {
-		log.Fatalln("unable to write all data to socket")
+	engine := newDownloadEngine(metainfo.InfoHash, newPeerPool(peers), DownloadFileInfo{
+		storage:  storage,
+		verifier: verifier,
+		session:  session,
+	}, newRarestFirstPicker(storage.PieceCount()), *maxPeers)
+	if err := engine.Run(); err != nil {
+		log.Fatalln("unable to download file", err)
 	}
 
-	receivedLen, receivedBytes, err = client.Receive(1024)
-	if err != nil {
-		log.Fatalln("unable to read data from socket")
+	if err := session.Completed(); err != nil {
+		log.Println("unable to announce completion", err)
 	}
-
-	err = downloadFile(client, DownloadFileInfo{
-		path:        args[1],
-		fileLength:  metainfo.Info.Length,
-		pieceLength: metainfo.Info.PieceLength,
-		pieceHashes: metainfo.Info.Pieces,
-	})
-	if err != nil {
-		log.Fatalln("unable to download file", err)
+	if err := session.Stop(); err != nil {
+		log.Println("unable to announce stop", err)
 	}
 
-	fmt.Printf("File downloaded to %s\n", args[1])
+	fmt.Printf("File downloaded to %s\n", *output)
 }
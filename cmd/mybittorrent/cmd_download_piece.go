@@ -1,47 +1,12 @@
 package main
 
 import (
-	"bytes"
-	"crypto/sha1"
-	"encoding/binary"
 	"fmt"
 	"log"
 	"os"
-	"slices"
 	"strconv"
 )
 
-type PeerMessage struct {
-	length  uint32
-	id      byte
-	payload []byte
-}
-
-func (pm *PeerMessage) serialize() []byte {
-	var payload bytes.Buffer
-	var length [4]byte
-	// 1 bit to account for message id
-	binary.BigEndian.PutUint32(length[:], pm.length+1)
-	payload.Write(length[:])
-	payload.WriteByte(pm.id)
-	payload.Write(pm.payload)
-	return payload.Bytes()
-}
-
-func deserializePeerMessage(bytes []byte) PeerMessage {
-	length := binary.BigEndian.Uint32(bytes[0:4])
-	id := bytes[4]
-	var payload []byte
-	if length > 0 {
-		payload = bytes[5:]
-	}
-	return PeerMessage{
-		length:  length,
-		id:      id,
-		payload: payload,
-	}
-}
-
 func executeDownloadPiece(args []string) {
 	if len(args) < 4 {
 		log.Fatalln("usage: download_piece -o <out_dir> <torrent_file> <piece>")
@@ -64,6 +29,7 @@ func executeDownloadPiece(args []string) {
 	}
 
 	peers, err := getPeersFromMetainfo(&metainfo)
+	peers, err = withDHTFallback(metainfo.InfoHash, peers, err)
 	if err != nil {
 		log.Fatalln("unable to get peers from metainfo", err)
 	}
@@ -71,7 +37,7 @@ func executeDownloadPiece(args []string) {
 		log.Fatalln("no peers available")
 	}
 
-	client, err := NewTCPClient(peers[0])
+	client, err := NewTCPClient(peers[0].String())
 	if err != nil {
 		log.Fatalln("unable to create tcp client")
 	}
@@ -82,44 +48,41 @@ func executeDownloadPiece(args []string) {
 		log.Fatalln("unable to write all data to socket")
 	}
 
-	receivedLen, receivedBytes, err := client.Receive(1024)
+	handshake, err := client.ReadHandshake()
 	if err != nil {
-		log.Fatalln("unable to read data from socket")
+		log.Fatalln("unable to read data from socket", err)
 	}
-	fmt.Printf("Peer ID: %x\n", receivedBytes[receivedLen-20:])
+	fmt.Printf("Peer ID: %x\n", handshake.PeerID)
 
-	receivedLen, receivedBytes, err = client.Receive(1024)
-	if err != nil {
-		log.Fatalln("unable to read data from socket")
+	conn := newPeerConn(client)
+	if err := conn.SetInterested(true); err != nil {
+		log.Fatalln(err)
 	}
 
-	interestedPacket := PeerMessage{
-		length:  1,
-		id:      2,
-		payload: make([]byte, 0),
-	}
-	_, err = client.Write(interestedPacket.serialize())
+	storage, err := newStorage(args[1], &metainfo.Info)
 	if err != nil {
-		log.Fatalln("unable to write all data to socket")
+		log.Fatalln("unable to lay out files", err)
 	}
-
-	receivedLen, receivedBytes, err = client.Receive(1024)
+	if pieceIndex < 0 || pieceIndex >= storage.PieceCount() {
+		log.Fatalln("invalid piece number", pieceIndex)
+	}
+	verifier, err := newPieceVerifier(&metainfo.Info, metainfo.PieceLayers)
 	if err != nil {
-		log.Fatalln("unable to read data from socket")
+		log.Fatalln("unable to verify pieces", err)
 	}
 
-	pieceData, err := downloadPiece(client, DownloadPieceInfo{
-		index:      pieceIndex,
-		length:     metainfo.Info.PieceLength,
-		fileLength: metainfo.Info.Length,
+	pieceData, err := downloadPiece(conn, DownloadPieceInfo{
+		index:  pieceIndex,
+		count:  storage.PieceCount(),
+		length: metainfo.Info.PieceLength,
+		size:   storage.PieceSize(pieceIndex),
 	})
 	if err != nil {
 		log.Fatalln("Unable to download piece", pieceIndex, err)
 	}
 
-	sum := sha1.Sum(pieceData)
-	if !slices.Equal(metainfo.Info.Pieces[pieceIndex], sum[:]) {
-		log.Fatalf("\ninvalid hash of downloaded piece. want: %x, got: %x", metainfo.Info.Pieces[pieceIndex], sum[:])
+	if err := verifier.Verify(pieceIndex, pieceData); err != nil {
+		log.Fatalln(err)
 	} else {
 		fmt.Println("\nBlock checksum matches")
 	}
@@ -56,10 +56,10 @@ func executeHandshake(args []string) {
 		log.Fatalln("unable to write all data to client", err)
 	}
 
-	receivedLen, receivedBytes, err := client.Receive(68)
+	handshake, err := client.ReadHandshake()
 	if err != nil {
 		log.Fatalln("unable to read data from client", err)
 	}
 
-	fmt.Printf("Peer ID: %x\n", receivedBytes[receivedLen-20:])
+	fmt.Printf("Peer ID: %x\n", handshake.PeerID)
 }
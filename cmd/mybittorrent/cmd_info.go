@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path"
 )
 
 func executeInfo(args []string) {
@@ -23,11 +24,27 @@ func executeInfo(args []string) {
 	}
 
 	fmt.Printf("Tracker URL: %s\n", metainfo.Announce)
-	fmt.Printf("Length: %d\n", metainfo.Info.Length)
+	fmt.Printf("Length: %d\n", metainfo.Info.TotalLength())
 	fmt.Printf("Info Hash: %x\n", metainfo.InfoHash)
+	if metainfo.InfoHashV2 != nil {
+		fmt.Printf("Info Hash v2: %x\n", metainfo.InfoHashV2)
+	}
 	fmt.Printf("Piece Length: %d\n", metainfo.Info.PieceLength)
 	fmt.Println("Piece Hashes:")
-	for _, piece := range metainfo.Info.Pieces {
+	for _, piece := range metainfo.Info.PieceHashes() {
 		fmt.Printf("%x\n", piece)
 	}
+	if !metainfo.Info.HasV1() {
+		fmt.Println("Files:")
+		for _, file := range metainfo.Info.V2Files() {
+			fmt.Printf("%d %s %x\n", file.Length, path.Join(file.Path...), file.PiecesRoot)
+		}
+	} else if metainfo.Info.IsMultiFile() {
+		fmt.Println("Files:")
+		for _, file := range metainfo.Info.Files {
+			if !file.IsPadding() {
+				fmt.Printf("%d %s\n", file.Length, path.Join(file.Path...))
+			}
+		}
+	}
 }
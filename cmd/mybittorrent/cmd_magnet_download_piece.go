@@ -3,15 +3,10 @@ package main
 import (
 	"bytes"
 	"crypto/sha1"
-	"encoding/binary"
 	"fmt"
 	"log"
 	"os"
-	"slices"
 	"strconv"
-	"strings"
-
-	bencode "github.com/jackpal/bencode-go"
 )
 
 func executeMagnetDownloadPiece(args []string) {
@@ -30,8 +25,9 @@ func executeMagnetDownloadPiece(args []string) {
 	}
 
 	metainfo := Metainfo{
-		Announce: magnet.tracker_url,
-		InfoHash: []byte(magnet.info_hash),
+		Announce:     magnet.tracker_url,
+		AnnounceList: [][]string{magnet.tracker_urls},
+		InfoHash:     []byte(magnet.info_hash),
 		Info: Info{
 			Name:   magnet.file_name,
 			Length: 42,
@@ -39,11 +35,12 @@ func executeMagnetDownloadPiece(args []string) {
 	}
 
 	peers, err := getPeersFromMetainfo(&metainfo)
+	peers, err = withDHTFallback(metainfo.InfoHash, peers, err)
 	if err != nil {
 		log.Fatalln("unable to get peers from metainfo", err)
 	}
 
-	client, err := NewTCPClient(peers[0])
+	client, err := NewTCPClient(peers[0].String())
 	if err != nil {
 		log.Fatalln("unable to create tcp client", err)
 	}
@@ -54,134 +51,106 @@ func executeMagnetDownloadPiece(args []string) {
 		log.Fatalln("unable to write all data to client", err)
 	}
 
-	receivedBytes, err := client.ReceiveExact(68)
+	handshake, err := client.ReadHandshake()
 	if err != nil {
 		log.Fatalln("unable to read data from client", err)
 	}
-
-	// ignore bitfield msg
-	_, err = client.ReceiveExact(6)
-	if err != nil {
-		log.Fatalln("unable to read data from client", err)
+	if !handshake.SupportsExtensions() {
+		log.Fatalln("peer does not support the extension protocol")
 	}
+	conn := newPeerConn(client)
 
-	extensionPayload := map[string]any{
-		"m": map[string]any{
-			"ut_metadata": 42,
-		},
-	}
-	encodedExtensionPayload := new(strings.Builder)
-	bencode.Marshal(encodedExtensionPayload, extensionPayload)
-
-	extensionBuffer := new(bytes.Buffer)
-	binary.Write(extensionBuffer, binary.BigEndian, []byte{0})
-	binary.Write(extensionBuffer, binary.BigEndian, []byte(encodedExtensionPayload.String()))
-
-	extensionHandshake := PeerMessage{
-		length:  uint32(extensionBuffer.Len()),
-		id:      20,
-		payload: extensionBuffer.Bytes(),
+	extensionHandshake, err := newExtensionHandshakePacket()
+	if err != nil {
+		log.Fatalln(err)
 	}
 
-	_, err = client.Write(extensionHandshake.serialize())
+	err = client.WriteMessage(extensionHandshake)
 	if err != nil {
-		log.Fatalln("unable to write all data to socket", err)
+		log.Fatalln(err)
 	}
 
-	_, receivedBytes, err = client.Receive(1024)
+	payload, err := conn.WaitForExtended(0)
 	if err != nil {
-		log.Fatalln("unable to read data from socket")
+		log.Fatalln("unable to read data from socket", err)
 	}
 
-	decodedExtensionResponse, err := decodeBencode(string(receivedBytes[6:]))
+	extensionResponse, err := parseExtensionHandshake(payload)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	extensionId := decodedExtensionResponse.(map[string]any)["m"].(map[string]any)["ut_metadata"].(int)
-
-	requestPayload := map[string]any{
-		"msg_type": 0,
-		"piece":    0,
+	extensionId, ok := extensionResponse.M["ut_metadata"]
+	if !ok {
+		log.Fatalln("peer does not support the metadata extension")
 	}
-	encodedRequestPayload := new(strings.Builder)
-	bencode.Marshal(encodedRequestPayload, requestPayload)
-
-	requestBuffer := new(bytes.Buffer)
-	binary.Write(requestBuffer, binary.BigEndian, byte(extensionId))
-	binary.Write(requestBuffer, binary.BigEndian, []byte(encodedRequestPayload.String()))
 
-	requestPacket := PeerMessage{
-		length:  uint32(requestBuffer.Len()),
-		id:      20,
-		payload: requestBuffer.Bytes(),
+	requestPacket, err := newMetadataRequestPacket(extensionId, 0)
+	if err != nil {
+		log.Fatalln(err)
 	}
 
-	_, err = client.Write(requestPacket.serialize())
+	err = client.WriteMessage(requestPacket)
 	if err != nil {
-		log.Fatalln("unable to write all data to socket", err)
+		log.Fatalln(err)
 	}
 
-	_, receivedBytes, err = client.Receive(1024)
+	payload, err = conn.WaitForExtended(utMetadataID)
 	if err != nil {
-		log.Fatalln("unable to read data from socket")
+		log.Fatalln("unable to read data from socket", err)
 	}
 
-	decodedRequestResponse, err := decodeBencode(string(receivedBytes[6:]))
+	_, metadata, err := parseMetadataMessage(payload)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	firstDict := new(strings.Builder)
-	bencode.Marshal(firstDict, decodedRequestResponse)
-	decodedPiecesDict, err := decodeBencode(string(receivedBytes[firstDict.Len()+6:]))
+	info, err := parseInfo(metadata)
 	if err != nil {
 		log.Fatalln(err)
 	}
-
-	rawPieces := []byte(decodedPiecesDict.(map[string]any)["pieces"].(string))
-	piecesCount := len(rawPieces) / 20
-	pieces := make([][]byte, 0, piecesCount)
-	for i := 0; i < piecesCount; i++ {
-		pieces = append(pieces, rawPieces[i*20:(i+1)*20])
+	if metadataHash := sha1.Sum(metadata); !bytes.Equal(metadataHash[:], metainfo.InfoHash) {
+		log.Fatalf("metadata hash mismatch. want: %x, got: %x", metainfo.InfoHash, metadataHash[:])
 	}
+	pieces := info.PieceHashes()
 
 	fmt.Printf("Tracker URL: %s\n", metainfo.Announce)
-	fmt.Printf("Length: %d\n", decodedPiecesDict.(map[string]any)["length"])
+	fmt.Printf("Length: %d\n", info.TotalLength())
 	fmt.Printf("Info Hash: %x\n", metainfo.InfoHash)
-	fmt.Printf("Piece Length: %d\n", decodedPiecesDict.(map[string]any)["piece length"])
+	fmt.Printf("Piece Length: %d\n", info.PieceLength)
 	fmt.Printf("Piece Hashes:\n")
 	for _, piece := range pieces {
 		fmt.Printf("%x\n", piece)
 	}
 
-	interestedPacket := PeerMessage{
-		length:  1,
-		id:      2,
-		payload: make([]byte, 0),
+	if err := conn.SetInterested(true); err != nil {
+		log.Fatalln(err)
 	}
-	_, err = client.Write(interestedPacket.serialize())
+
+	storage, err := newStorage(args[1], &info)
 	if err != nil {
-		log.Fatalln("unable to write all data to socket")
+		log.Fatalln("unable to lay out files", err)
 	}
-
-	_, receivedBytes, err = client.Receive(1024)
+	if pieceIndex < 0 || pieceIndex >= storage.PieceCount() {
+		log.Fatalln("invalid piece number", pieceIndex)
+	}
+	verifier, err := newPieceVerifier(&info, nil)
 	if err != nil {
-		log.Fatalln("unable to read data from socket")
+		log.Fatalln("unable to verify pieces", err)
 	}
 
-	pieceData, err := downloadPiece(client, DownloadPieceInfo{
-		index:      pieceIndex,
-		length:     decodedPiecesDict.(map[string]any)["piece length"].(int),
-		fileLength: decodedPiecesDict.(map[string]any)["length"].(int),
+	pieceData, err := downloadPiece(conn, DownloadPieceInfo{
+		index:  pieceIndex,
+		count:  storage.PieceCount(),
+		length: info.PieceLength,
+		size:   storage.PieceSize(pieceIndex),
 	})
 	if err != nil {
 		log.Fatalln("Unable to download piece", pieceIndex, err)
 	}
 
-	sum := sha1.Sum(pieceData)
-	if !slices.Equal(pieces[pieceIndex], sum[:]) {
-		log.Fatalf("\ninvalid hash of downloaded piece. want: %x, got: %x", pieces[pieceIndex], sum[:])
+	if err := verifier.Verify(pieceIndex, pieceData); err != nil {
+		log.Fatalln(err)
 	} else {
 		fmt.Println("\nBlock checksum matches")
 	}
@@ -1,13 +1,8 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
 	"fmt"
 	"log"
-	"strings"
-
-	bencode "github.com/jackpal/bencode-go"
 )
 
 func executeMagnetHandshake(args []string) {
@@ -21,8 +16,9 @@ func executeMagnetHandshake(args []string) {
 	}
 
 	metainfo := Metainfo{
-		Announce: magnet.tracker_url,
-		InfoHash: []byte(magnet.info_hash),
+		Announce:     magnet.tracker_url,
+		AnnounceList: [][]string{magnet.tracker_urls},
+		InfoHash:     []byte(magnet.info_hash),
 		Info: Info{
 			Name:   magnet.file_name,
 			Length: 42,
@@ -30,11 +26,12 @@ func executeMagnetHandshake(args []string) {
 	}
 
 	peers, err := getPeersFromMetainfo(&metainfo)
+	peers, err = withDHTFallback(metainfo.InfoHash, peers, err)
 	if err != nil {
 		log.Fatalln("unable to get peers from metainfo", err)
 	}
 
-	client, err := NewTCPClient(peers[0])
+	client, err := NewTCPClient(peers[0].String())
 	if err != nil {
 		log.Fatalln("unable to create tcp client", err)
 	}
@@ -45,51 +42,36 @@ func executeMagnetHandshake(args []string) {
 		log.Fatalln("unable to write all data to client", err)
 	}
 
-	receivedBytes, err := client.ReceiveExact(68)
+	handshake, err := client.ReadHandshake()
 	if err != nil {
 		log.Fatalln("unable to read data from client", err)
 	}
-	fmt.Printf("Peer ID: %x\n", receivedBytes[48:68])
-
-	// ignore bitfield msg
-	_, err = client.ReceiveExact(6)
-	if err != nil {
-		log.Fatalln("unable to read data from client", err)
+	fmt.Printf("Peer ID: %x\n", handshake.PeerID)
+	if !handshake.SupportsExtensions() {
+		log.Fatalln("peer does not support the extension protocol")
 	}
+	conn := newPeerConn(client)
 
-	extensionPayload := map[string]any{
-		"m": map[string]any{
-			"ut_metadata": 42,
-		},
-	}
-	encodedExtensionPayload := new(strings.Builder)
-	bencode.Marshal(encodedExtensionPayload, extensionPayload)
-
-	extensionBuffer := new(bytes.Buffer)
-	binary.Write(extensionBuffer, binary.BigEndian, []byte{0})
-	binary.Write(extensionBuffer, binary.BigEndian, []byte(encodedExtensionPayload.String()))
-
-	requestPacket := PeerMessage{
-		length:  uint32(extensionBuffer.Len()),
-		id:      20,
-		payload: extensionBuffer.Bytes(),
+	requestPacket, err := newExtensionHandshakePacket()
+	if err != nil {
+		log.Fatalln(err)
 	}
 
-	_, err = client.Write(requestPacket.serialize())
+	err = client.WriteMessage(requestPacket)
 	if err != nil {
-		log.Fatalln("unable to write all data to socket", err)
+		log.Fatalln(err)
 	}
 
-	_, receivedBytes, err = client.Receive(1024)
+	payload, err := conn.WaitForExtended(0)
 	if err != nil {
-		log.Fatalln("unable to read data from socket")
+		log.Fatalln("unable to read data from socket", err)
 	}
 
-	decodedExtensionResponse, err := decodeBencode(string(receivedBytes[6:]))
+	extensionResponse, err := parseExtensionHandshake(payload)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	extensionId := decodedExtensionResponse.(map[string]any)["m"].(map[string]any)["ut_metadata"]
+	extensionId := extensionResponse.M["ut_metadata"]
 	fmt.Printf("Peer Metadata Extension ID: %d\n", extensionId)
 }
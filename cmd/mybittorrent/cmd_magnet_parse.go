@@ -13,6 +13,8 @@ type Magnet struct {
 	info_hash   []byte
 	file_name   string
 	tracker_url string
+	// tracker_urls holds every tr parameter, tracker_url is the first one.
+	tracker_urls []string
 }
 
 func parseMagnet(link string) (Magnet, error) {
@@ -30,6 +32,14 @@ func parseMagnet(link string) (Magnet, error) {
 		splitParts := strings.SplitN(part, "=", 2)
 		key := splitParts[0]
 		value := splitParts[1]
+		if key == "tr" {
+			unescaped, err := url.PathUnescape(value)
+			if err != nil {
+				return magnet, fmt.Errorf("invalid tracker_url value, cannot unescape the value: %s", value)
+			}
+			magnet.tracker_urls = append(magnet.tracker_urls, unescaped)
+			continue
+		}
 		values[key] = value
 	}
 
@@ -43,11 +53,9 @@ func parseMagnet(link string) (Magnet, error) {
 	}
 	magnet.info_hash = xt
 	magnet.file_name = values["dn"]
-	unescaped, err := url.PathUnescape(values["tr"])
-	if err != nil {
-		return magnet, fmt.Errorf("invalid tracker_url value, cannot unescape the value: %s", values["tr"])
+	if len(magnet.tracker_urls) > 0 {
+		magnet.tracker_url = magnet.tracker_urls[0]
 	}
-	magnet.tracker_url = unescaped
 
 	return magnet, nil
 }
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+func executeScrape(args []string) {
+	if len(args) < 1 {
+		log.Fatalln("usage: scrape <torrent_file|magnet-link>")
+	}
+
+	var metainfo Metainfo
+	if strings.HasPrefix(args[0], "magnet:?") {
+		magnet, err := parseMagnet(args[0])
+		if err != nil {
+			log.Fatalln("error parsing magnet link", err)
+		}
+		metainfo = Metainfo{
+			Announce:     magnet.tracker_url,
+			AnnounceList: [][]string{magnet.tracker_urls},
+			InfoHash:     []byte(magnet.info_hash),
+		}
+	} else {
+		f, err := os.Open(args[0])
+		if err != nil {
+			log.Fatalln("error opening metainfo file", err)
+		}
+		defer f.Close()
+
+		metainfo, err = parseMetainfo(f)
+		if err != nil {
+			log.Fatalln("error parsing metainfo file", err)
+		}
+	}
+
+	trackers := newTrackerTiers(&metainfo).URLs()
+	if len(trackers) == 0 {
+		log.Fatalln("torrent has no trackers")
+	}
+
+	var answered int
+	for i, trackerURL := range trackers {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("Tracker URL: %s\n", trackerURL)
+		stats, err := scrape(trackerURL, [][]byte{metainfo.InfoHash})
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			continue
+		}
+		answered++
+		fmt.Printf("Seeders: %d\n", stats[0].Complete)
+		fmt.Printf("Leechers: %d\n", stats[0].Incomplete)
+		fmt.Printf("Completed: %d\n", stats[0].Downloaded)
+	}
+	if answered == 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+func executeTracker(args []string) {
+	flags := flag.NewFlagSet("tracker", flag.ExitOnError)
+	httpAddr := flags.String("http", ":6969", "address to serve HTTP announce and scrape on")
+	udpAddr := flags.String("udp", "", "address to serve the UDP tracker protocol on (default: disabled)")
+	interval := flags.Duration("interval", 30*time.Minute, "announce interval handed out to clients")
+	var allowed stringList
+	flags.Var(&allowed, "allow", "hex info hash of a torrent to track; may be repeated (default: track every torrent)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: tracker [options]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *interval < time.Second {
+		log.Fatalln("interval must be at least one second")
+	}
+
+	var allowedHashes [][]byte
+	for _, value := range allowed {
+		infoHash, err := hex.DecodeString(value)
+		if err != nil || len(infoHash) != sha1.Size {
+			log.Fatalf("invalid info hash: %s\n", value)
+		}
+		allowedHashes = append(allowedHashes, infoHash)
+	}
+
+	server := newTrackerServer(*interval, allowedHashes)
+
+	if *udpAddr != "" {
+		conn, err := net.ListenPacket("udp", *udpAddr)
+		if err != nil {
+			log.Fatalln("unable to listen for udp", err)
+		}
+		fmt.Printf("UDP tracker listening on %s\n", conn.LocalAddr())
+		go func() {
+			log.Fatalln("udp tracker stopped", server.ServeUDP(conn))
+		}()
+	}
+
+	listener, err := net.Listen("tcp", *httpAddr)
+	if err != nil {
+		log.Fatalln("unable to listen for http", err)
+	}
+	fmt.Printf("HTTP tracker listening on %s\n", listener.Addr())
+	log.Fatalln("http tracker stopped", http.Serve(listener, server.Handler()))
+}
@@ -1,53 +1,48 @@
 package main
 
 import (
-	"bytes"
-	"io"
+	"fmt"
 	"net"
+	"time"
 )
 
+// peerReadTimeout is how long a peer may stay silent. Peers send a
+// keep-alive at least every two minutes.
+const peerReadTimeout = 3 * time.Minute
+
 type TCPClient struct {
 	net.Conn
+	reader *MessageReader
 }
 
 func NewTCPClient(address string) (*TCPClient, error) {
-	conn, err := net.Dial("tcp", address)
+	conn, err := dialTCP(address)
 	if err != nil {
 		return nil, err
 	}
 	return &TCPClient{
-		Conn: conn,
+		Conn:   conn,
+		reader: NewMessageReader(conn),
 	}, nil
 }
 
-func (c *TCPClient) Receive(bufSize int) (int, []byte, error) {
-	var received int
-	buffer := bytes.NewBuffer(nil)
-	for {
-		chunk := make([]byte, bufSize)
-		read, err := c.Conn.Read(chunk)
-		if err != nil && err != io.EOF {
-			return received, buffer.Bytes(), err
-		}
-		received += read
-		buffer.Write(chunk[:read])
+func (c *TCPClient) ReadHandshake() (Handshake, error) {
+	if err := c.SetReadDeadline(time.Now().Add(peerReadTimeout)); err != nil {
+		return Handshake{}, err
+	}
+	return c.reader.ReadHandshake()
+}
 
-		if read == 0 || read < bufSize {
-			break
-		}
+func (c *TCPClient) ReadMessage() (PeerMessage, error) {
+	if err := c.SetReadDeadline(time.Now().Add(peerReadTimeout)); err != nil {
+		return PeerMessage{}, err
 	}
-	return received, buffer.Bytes(), nil
+	return c.reader.ReadMessage()
 }
 
-func (c *TCPClient) ReceiveExact(expectedSize int) ([]byte, error) {
-	buffer := bytes.NewBuffer(nil)
-	for {
-		chunk := make([]byte, expectedSize)
-		io.ReadFull(c.Conn, chunk)
-		buffer.Write(chunk)
-		if buffer.Len() == expectedSize {
-			break
-		}
+func (c *TCPClient) WriteMessage(msg PeerMessage) error {
+	if _, err := c.Write(msg.serialize()); err != nil {
+		return fmt.Errorf("unable to write all data to socket: %w", err)
 	}
-	return buffer.Bytes(), nil
+	return nil
 }
@@ -0,0 +1,709 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	mathrand "math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// dhtAlpha is the number of queries a lookup keeps in flight.
+	dhtAlpha        = 3
+	dhtQueryTimeout = 2 * time.Second
+	// dhtTokenLifetime is how often the secret behind announce tokens
+	// rotates; tokens from the previous secret are still accepted.
+	dhtTokenLifetime = 5 * time.Minute
+	dhtPeerLifetime  = 30 * time.Minute
+	// dhtCleanupInterval is how often expired peers and items are removed.
+	dhtCleanupInterval = time.Minute
+	// A get_peers response carries at most dhtMaxValues peers, picked at
+	// random, to stay within a single packet. A node stores up to
+	// dhtMaxTorrentPeers peers per torrent and dhtMaxStoredPeers in total.
+	dhtMaxValues       = 100
+	dhtMaxTorrentPeers = 1000
+	dhtMaxStoredPeers  = 50000
+)
+
+// dhtDefaultBootstrap are the well-known routers used to join the DHT. They
+// can be replaced with a comma separated list of host:port in the
+// BITTORRENT_DHT_BOOTSTRAP environment variable.
+var dhtDefaultBootstrap = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+func dhtBootstrapNodes() []string {
+	if value := os.Getenv("BITTORRENT_DHT_BOOTSTRAP"); value != "" {
+		return strings.Split(value, ",")
+	}
+	return dhtDefaultBootstrap
+}
+
+// KRPC error codes (BEP 5).
+const (
+	krpcGenericError  = 201
+	krpcProtocolError = 203
+	krpcMethodUnknown = 204
+)
+
+type krpcMessage struct {
+	T string      `bencode:"t,required"`
+	Y string      `bencode:"y,required"`
+	Q string      `bencode:"q,omitempty"`
+	A *krpcArgs   `bencode:"a,omitempty"`
+	R *krpcReturn `bencode:"r,omitempty"`
+	E []any       `bencode:"e,omitempty"`
+}
+
+type krpcArgs struct {
+	ID          []byte `bencode:"id,required"`
+	Target      []byte `bencode:"target,omitempty"`
+	InfoHash    []byte `bencode:"info_hash,omitempty"`
+	Port        int    `bencode:"port,omitempty"`
+	ImpliedPort int    `bencode:"implied_port,omitempty"`
+	Token       []byte `bencode:"token,omitempty"`
+	// BEP 44 get and put arguments.
+	V    RawMessage `bencode:"v,omitempty"`
+	K    []byte     `bencode:"k,omitempty"`
+	Sig  []byte     `bencode:"sig,omitempty"`
+	Seq  *int64     `bencode:"seq,omitempty"`
+	Salt []byte     `bencode:"salt,omitempty"`
+	CAS  *int64     `bencode:"cas,omitempty"`
+}
+
+type krpcReturn struct {
+	ID     []byte     `bencode:"id,required"`
+	Nodes  []byte     `bencode:"nodes,omitempty"`
+	Values [][]byte   `bencode:"values,omitempty"`
+	Token  []byte     `bencode:"token,omitempty"`
+	V      RawMessage `bencode:"v,omitempty"`
+	K      []byte     `bencode:"k,omitempty"`
+	Sig    []byte     `bencode:"sig,omitempty"`
+	Seq    *int64     `bencode:"seq,omitempty"`
+}
+
+// KRPCError is an error message sent by a DHT node.
+type KRPCError struct {
+	Code    int
+	Message string
+}
+
+func (e *KRPCError) Error() string {
+	return fmt.Sprintf("dht error %d: %s", e.Code, e.Message)
+}
+
+// dhtResponse is a response or error message and the node it came from.
+type dhtResponse struct {
+	message *krpcMessage
+	from    netip.AddrPort
+}
+
+type dhtStoredPeer struct {
+	addr    netip.AddrPort
+	expires time.Time
+}
+
+// DHT is a node of the mainline DHT (BEP 5). It answers queries from other
+// nodes while it runs, so peers announced to it are served to others.
+type DHT struct {
+	id    NodeID
+	conn  net.PacketConn
+	table *RoutingTable
+
+	mu            sync.Mutex
+	pending       map[string]chan dhtResponse
+	transaction   uint16
+	peers         map[string][]dhtStoredPeer
+	peerCount     int
+	items         map[NodeID]dhtItem
+	secrets       [2][]byte
+	secretRotated time.Time
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// listenDHT starts a DHT node on a local UDP address, such as ":0" for any
+// free port.
+func listenDHT(address string) (*DHT, error) {
+	conn, err := net.ListenPacket("udp4", address)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen for dht: %w", err)
+	}
+	return newDHT(conn), nil
+}
+
+// newDHT starts a DHT node on conn, which it takes ownership of.
+func newDHT(conn net.PacketConn) *DHT {
+	d := &DHT{
+		id:      randomNodeID(),
+		conn:    conn,
+		pending: make(map[string]chan dhtResponse),
+		peers:   make(map[string][]dhtStoredPeer),
+		items:   make(map[NodeID]dhtItem),
+		closed:  make(chan struct{}),
+	}
+	d.table = newRoutingTable(d.id)
+	d.secrets[0] = newDHTSecret()
+	d.secrets[1] = d.secrets[0]
+	d.secretRotated = time.Now()
+	go d.serve()
+	go d.cleanup()
+	return d
+}
+
+func newDHTSecret() []byte {
+	secret := make([]byte, 16)
+	rand.Read(secret)
+	return secret
+}
+
+func (d *DHT) Addr() netip.AddrPort {
+	addr, _ := netip.ParseAddrPort(d.conn.LocalAddr().String())
+	return addr
+}
+
+func (d *DHT) Close() error {
+	d.closeOnce.Do(func() { close(d.closed) })
+	return d.conn.Close()
+}
+
+// cleanup periodically removes what other nodes stored that has expired, as
+// a torrent nobody asks about again would otherwise be kept forever.
+func (d *DHT) cleanup() {
+	ticker := time.NewTicker(dhtCleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.closed:
+			return
+		case now := <-ticker.C:
+			d.expire(now)
+		}
+	}
+}
+
+func (d *DHT) expire(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for infoHash := range d.peers {
+		d.expirePeers(infoHash, now)
+	}
+	for target, item := range d.items {
+		if !now.Before(item.expires) {
+			delete(d.items, target)
+		}
+	}
+}
+
+func (d *DHT) serve() {
+	buffer := make([]byte, 64*1024)
+	for {
+		read, addr, err := d.conn.ReadFrom(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		remote := netip.AddrPortFrom(udpAddr.AddrPort().Addr().Unmap(), udpAddr.AddrPort().Port())
+
+		var message krpcMessage
+		if err := Unmarshal(buffer[:read], &message); err != nil {
+			continue
+		}
+		switch message.Y {
+		case "q":
+			d.handleQuery(&message, remote)
+		case "r", "e":
+			d.mu.Lock()
+			response, ok := d.pending[message.T]
+			delete(d.pending, message.T)
+			d.mu.Unlock()
+			if ok {
+				response <- dhtResponse{message: &message, from: remote}
+			}
+		}
+	}
+}
+
+func (d *DHT) send(message *krpcMessage, addr net.Addr) error {
+	encoded, err := Marshal(message)
+	if err != nil {
+		return err
+	}
+	_, err = d.conn.WriteTo(encoded, addr)
+	return err
+}
+
+// query sends a KRPC query and waits for its response. Nodes that answer are
+// added to the routing table.
+func (d *DHT) query(addr netip.AddrPort, method string, args krpcArgs) (*krpcReturn, error) {
+	addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+	return d.queryAddr(net.UDPAddrFromAddrPort(addr), method, args)
+}
+
+// queryAddr is query for any destination, including the host names of
+// bootstrap nodes that a proxy resolves.
+func (d *DHT) queryAddr(addr net.Addr, method string, args krpcArgs) (*krpcReturn, error) {
+	args.ID = d.id[:]
+
+	d.mu.Lock()
+	d.transaction++
+	transaction := string(binary.BigEndian.AppendUint16(nil, d.transaction))
+	responses := make(chan dhtResponse, 1)
+	d.pending[transaction] = responses
+	d.mu.Unlock()
+
+	err := d.send(&krpcMessage{T: transaction, Y: "q", Q: method, A: &args}, addr)
+	if err != nil {
+		d.mu.Lock()
+		delete(d.pending, transaction)
+		d.mu.Unlock()
+		return nil, fmt.Errorf("unable to send %s query: %w", method, err)
+	}
+
+	timer := time.NewTimer(dhtQueryTimeout)
+	defer timer.Stop()
+	select {
+	case response := <-responses:
+		message := response.message
+		if message.Y == "e" {
+			return nil, parseKRPCError(message.E)
+		}
+		if message.R == nil || len(message.R.ID) != len(NodeID{}) {
+			return nil, fmt.Errorf("invalid %s response from %s", method, addr)
+		}
+		d.table.Seen(dhtContact{ID: NodeID(message.R.ID), Addr: response.from})
+		return message.R, nil
+	case <-timer.C:
+		d.mu.Lock()
+		delete(d.pending, transaction)
+		d.mu.Unlock()
+		return nil, fmt.Errorf("%s query to %s timed out", method, addr)
+	}
+}
+
+func parseKRPCError(e []any) error {
+	krpcErr := &KRPCError{Code: krpcGenericError}
+	if len(e) > 0 {
+		if code, ok := e[0].(int); ok {
+			krpcErr.Code = code
+		}
+	}
+	if len(e) > 1 {
+		if message, ok := e[1].(string); ok {
+			krpcErr.Message = message
+		}
+	}
+	return krpcErr
+}
+
+func (d *DHT) Ping(addr netip.AddrPort) (NodeID, error) {
+	response, err := d.query(addr, "ping", krpcArgs{})
+	if err != nil {
+		return NodeID{}, err
+	}
+	return NodeID(response.ID), nil
+}
+
+// Bootstrap joins the DHT through the given host:port nodes and fills the
+// routing table with a lookup of our own ID.
+func (d *DHT) Bootstrap(nodes []string) error {
+	var seeds []dhtContact
+	var errs []error
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			addr, err := resolveUDPAddr("udp4", node)
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+				return
+			}
+			response, err := d.queryAddr(addr, "find_node", krpcArgs{Target: d.id[:]})
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			seeds = append(seeds, parseCompactNodes(response.Nodes)...)
+		}()
+	}
+	wg.Wait()
+
+	d.lookup(d.id, seeds, func(contact dhtContact) (*krpcReturn, error) {
+		return d.query(contact.Addr, "find_node", krpcArgs{Target: d.id[:]})
+	})
+	if d.table.Len() == 0 {
+		return fmt.Errorf("unable to join the dht: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// lookupResult is a node that answered during a lookup, with its answer.
+type lookupResult struct {
+	contact  dhtContact
+	response *krpcReturn
+}
+
+// lookup runs an iterative Kademlia lookup for target, starting from the
+// closest nodes in the routing table and seeds. query is sent to up to
+// dhtAlpha nodes at a time, each round moving closer to target through the
+// nodes returned, until the dhtBucketSize closest nodes seen have all been
+// queried. The nodes that answered are returned closest first.
+func (d *DHT) lookup(target NodeID, seeds []dhtContact, query func(contact dhtContact) (*krpcReturn, error)) []lookupResult {
+	candidates := append(d.table.Closest(target, dhtBucketSize), seeds...)
+	seen := make(map[NodeID]bool)
+	queried := make(map[NodeID]bool)
+	var shortlist []dhtContact
+	addCandidates := func(contacts []dhtContact) {
+		for _, contact := range contacts {
+			if contact.ID == d.id || seen[contact.ID] {
+				continue
+			}
+			seen[contact.ID] = true
+			shortlist = append(shortlist, contact)
+		}
+		sortByDistance(shortlist, target)
+	}
+	addCandidates(candidates)
+
+	var results []lookupResult
+	for {
+		var batch []dhtContact
+		for _, contact := range shortlist[:min(dhtBucketSize, len(shortlist))] {
+			if !queried[contact.ID] && len(batch) < dhtAlpha {
+				batch = append(batch, contact)
+				queried[contact.ID] = true
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		responses := make([]*krpcReturn, len(batch))
+		var wg sync.WaitGroup
+		for i, contact := range batch {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				response, err := query(contact)
+				if err != nil {
+					d.table.Failed(contact.ID)
+					return
+				}
+				responses[i] = response
+			}()
+		}
+		wg.Wait()
+
+		for i, response := range responses {
+			if response == nil {
+				shortlist = removeContact(shortlist, batch[i].ID)
+				continue
+			}
+			results = append(results, lookupResult{contact: batch[i], response: response})
+			addCandidates(parseCompactNodes(response.Nodes))
+		}
+	}
+
+	slices.SortFunc(results, func(a, b lookupResult) int {
+		da, db := target.distance(a.contact.ID), target.distance(b.contact.ID)
+		return bytes.Compare(da[:], db[:])
+	})
+	return results
+}
+
+func removeContact(contacts []dhtContact, id NodeID) []dhtContact {
+	for i, contact := range contacts {
+		if contact.ID == id {
+			return append(contacts[:i], contacts[i+1:]...)
+		}
+	}
+	return contacts
+}
+
+// GetPeers looks up the peers of a torrent.
+func (d *DHT) GetPeers(infoHash []byte) ([]Peer, error) {
+	if len(infoHash) != sha1.Size {
+		return nil, errInvalidInfoHash
+	}
+	if d.table.Len() == 0 {
+		return nil, errors.New("dht routing table is empty")
+	}
+	results := d.lookup(NodeID(infoHash), nil, func(contact dhtContact) (*krpcReturn, error) {
+		return d.query(contact.Addr, "get_peers", krpcArgs{InfoHash: infoHash})
+	})
+
+	var peers []Peer
+	seen := make(map[netip.AddrPort]bool)
+	for _, result := range results {
+		for _, value := range result.response.Values {
+			for _, peer := range parseCompactPeers(value, net.IPv4len) {
+				if !seen[peer.AddrPort()] {
+					seen[peer.AddrPort()] = true
+					peers = append(peers, peer)
+				}
+			}
+		}
+	}
+	return peers, nil
+}
+
+// Announce tells the nodes closest to a torrent that we are a peer of it,
+// listening on port. A port of 0 asks them to use the source port of our
+// DHT traffic instead.
+func (d *DHT) Announce(infoHash []byte, port int) error {
+	if len(infoHash) != sha1.Size {
+		return errInvalidInfoHash
+	}
+	results := d.lookup(NodeID(infoHash), nil, func(contact dhtContact) (*krpcReturn, error) {
+		return d.query(contact.Addr, "get_peers", krpcArgs{InfoHash: infoHash})
+	})
+
+	args := krpcArgs{InfoHash: infoHash, Port: port}
+	if port == 0 {
+		args.ImpliedPort = 1
+	}
+	var announced int
+	var errs []error
+	for _, result := range results[:min(dhtBucketSize, len(results))] {
+		if result.response.Token == nil {
+			continue
+		}
+		args.Token = result.response.Token
+		if _, err := d.query(result.contact.Addr, "announce_peer", args); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		announced++
+	}
+	if announced == 0 {
+		return fmt.Errorf("no dht node accepted the announce: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+func (d *DHT) handleQuery(message *krpcMessage, remote netip.AddrPort) {
+	to := net.UDPAddrFromAddrPort(remote)
+	reply := func(response krpcReturn) {
+		response.ID = d.id[:]
+		d.send(&krpcMessage{T: message.T, Y: "r", R: &response}, to)
+	}
+	replyError := func(code int, text string) {
+		d.send(&krpcMessage{T: message.T, Y: "e", E: []any{code, text}}, to)
+	}
+
+	args := message.A
+	if args == nil || len(args.ID) != len(NodeID{}) {
+		replyError(krpcProtocolError, "invalid arguments")
+		return
+	}
+	d.table.Seen(dhtContact{ID: NodeID(args.ID), Addr: remote})
+
+	switch message.Q {
+	case "ping":
+		reply(krpcReturn{})
+
+	case "find_node":
+		if len(args.Target) != len(NodeID{}) {
+			replyError(krpcProtocolError, "invalid target")
+			return
+		}
+		reply(krpcReturn{Nodes: compactNodes(d.table.Closest(NodeID(args.Target), dhtBucketSize))})
+
+	case "get_peers":
+		if len(args.InfoHash) != sha1.Size {
+			replyError(krpcProtocolError, "invalid info_hash")
+			return
+		}
+		response := krpcReturn{Token: d.token(remote.Addr(), 0)}
+		for _, addr := range d.storedPeers(args.InfoHash) {
+			response.Values = append(response.Values, appendCompactPeer(nil, Peer{Addr: addr.Addr(), Port: addr.Port()}))
+		}
+		if len(response.Values) == 0 {
+			response.Nodes = compactNodes(d.table.Closest(NodeID(args.InfoHash), dhtBucketSize))
+		}
+		reply(response)
+
+	case "announce_peer":
+		if len(args.InfoHash) != sha1.Size {
+			replyError(krpcProtocolError, "invalid info_hash")
+			return
+		}
+		if !d.validToken(args.Token, remote.Addr()) {
+			replyError(krpcProtocolError, "invalid token")
+			return
+		}
+		port := args.Port
+		if args.ImpliedPort != 0 {
+			port = int(remote.Port())
+		}
+		if port <= 0 || port > 0xffff {
+			replyError(krpcProtocolError, "invalid port")
+			return
+		}
+		d.storePeer(args.InfoHash, netip.AddrPortFrom(remote.Addr(), uint16(port)))
+		reply(krpcReturn{})
+
+	case "get", "put":
+		handle := d.handleGet
+		if message.Q == "put" {
+			handle = d.handlePut
+		}
+		response, err := handle(args, remote.Addr())
+		if err != nil {
+			replyError(err.Code, err.Message)
+			return
+		}
+		reply(response)
+
+	default:
+		replyError(krpcMethodUnknown, "method unknown")
+	}
+}
+
+// token returns the announce token for addr, derived from the current
+// (generation 0) or previous (generation 1) secret.
+func (d *DHT) token(addr netip.Addr, generation int) []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if time.Since(d.secretRotated) > dhtTokenLifetime {
+		d.secrets[1] = d.secrets[0]
+		d.secrets[0] = newDHTSecret()
+		d.secretRotated = time.Now()
+	}
+	hash := sha1.New()
+	hash.Write(d.secrets[generation])
+	hash.Write(addr.AsSlice())
+	return hash.Sum(nil)[:8]
+}
+
+func (d *DHT) validToken(token []byte, addr netip.Addr) bool {
+	return string(token) == string(d.token(addr, 0)) || string(token) == string(d.token(addr, 1))
+}
+
+// storePeer records a peer announced for infoHash. When the torrent has as
+// many peers as a node keeps, the one closest to expiring is replaced; when
+// the node is full, new peers are dropped until others expire.
+func (d *DHT) storePeer(infoHash []byte, addr netip.AddrPort) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	expires := now.Add(dhtPeerLifetime)
+	stored := d.expirePeers(string(infoHash), now)
+	for i := range stored {
+		if stored[i].addr == addr {
+			stored[i].expires = expires
+			return
+		}
+	}
+	if len(stored) >= dhtMaxTorrentPeers {
+		oldest := 0
+		for i := range stored {
+			if stored[i].expires.Before(stored[oldest].expires) {
+				oldest = i
+			}
+		}
+		stored[oldest] = dhtStoredPeer{addr: addr, expires: expires}
+		return
+	}
+	if d.peerCount >= dhtMaxStoredPeers {
+		return
+	}
+	d.peers[string(infoHash)] = append(stored, dhtStoredPeer{addr: addr, expires: expires})
+	d.peerCount++
+}
+
+// storedPeers returns up to dhtMaxValues peers of infoHash, chosen at random.
+func (d *DHT) storedPeers(infoHash []byte) []netip.AddrPort {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	stored := d.expirePeers(string(infoHash), time.Now())
+	addrs := make([]netip.AddrPort, len(stored))
+	for i, peer := range stored {
+		addrs[i] = peer.addr
+	}
+	mathrand.Shuffle(len(addrs), func(i, j int) { addrs[i], addrs[j] = addrs[j], addrs[i] })
+	return addrs[:min(len(addrs), dhtMaxValues)]
+}
+
+// expirePeers drops the expired peers of infoHash and returns the others.
+// d.mu must be held.
+func (d *DHT) expirePeers(infoHash string, now time.Time) []dhtStoredPeer {
+	stored := d.peers[infoHash]
+	live := slices.DeleteFunc(stored, func(peer dhtStoredPeer) bool { return !now.Before(peer.expires) })
+	d.peerCount -= len(stored) - len(live)
+	if len(live) == 0 {
+		delete(d.peers, infoHash)
+		return nil
+	}
+	d.peers[infoHash] = live
+	return live
+}
+
+// getPeersFromDHT joins the DHT just long enough to look up the peers of a
+// torrent.
+func getPeersFromDHT(infoHash []byte) ([]Peer, error) {
+	d, err := joinDHT()
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	return d.GetPeers(infoHash)
+}
+
+// joinDHT starts a DHT node for a short-lived command and bootstraps it.
+func joinDHT() (*DHT, error) {
+	conn, err := listenUDP()
+	if err != nil {
+		return nil, fmt.Errorf("unable to open dht socket: %w", err)
+	}
+	d := newDHT(conn)
+	if err := d.Bootstrap(dhtBootstrapNodes()); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// withDHTFallback returns the peers found by the trackers, or, when they
+// found none, the peers the DHT knows about.
+func withDHTFallback(infoHash []byte, peers []Peer, trackerErr error) ([]Peer, error) {
+	if len(peers) > 0 {
+		return peers, nil
+	}
+	dhtPeers, err := getPeersFromDHT(infoHash)
+	if err != nil {
+		return nil, errors.Join(trackerErr, err)
+	}
+	if len(dhtPeers) == 0 {
+		return nil, errors.Join(trackerErr, errors.New("no peers found in the dht"))
+	}
+	return dhtPeers, nil
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+// Limits and error codes of DHT item storage (BEP 44).
+const (
+	dhtMaxItemSize  = 1000
+	dhtMaxSaltSize  = 64
+	dhtItemLifetime = 2 * time.Hour
+	// dhtMaxItems is how many items a node stores for others. New items are
+	// refused once it is full, which BEP 44 allows.
+	dhtMaxItems = 1000
+
+	krpcMessageTooBig    = 205
+	krpcInvalidSignature = 206
+	krpcSaltTooBig       = 207
+	krpcCASMismatch      = 301
+	krpcSequenceTooLow   = 302
+)
+
+// MutableItem is a value stored in the DHT under an ed25519 public key and an
+// optional salt. Only the holder of the private key can sign new versions,
+// and a higher sequence number replaces a lower one.
+type MutableItem struct {
+	PublicKey ed25519.PublicKey
+	Salt      []byte
+	Seq       int64
+	Value     RawMessage
+	Signature []byte
+}
+
+// newMutableItem encodes and signs v as version seq of the item.
+func newMutableItem(privateKey ed25519.PrivateKey, salt []byte, seq int64, v any) (*MutableItem, error) {
+	value, err := Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	item := &MutableItem{
+		PublicKey: privateKey.Public().(ed25519.PublicKey),
+		Salt:      salt,
+		Seq:       seq,
+		Value:     value,
+	}
+	if err := item.validateSize(); err != nil {
+		return nil, err
+	}
+	item.Signature = ed25519.Sign(privateKey, mutableSignatureData(salt, seq, value))
+	return item, nil
+}
+
+func (item *MutableItem) Target() NodeID {
+	return mutableTarget(item.PublicKey, item.Salt)
+}
+
+func (item *MutableItem) validateSize() error {
+	if len(item.Value) > dhtMaxItemSize {
+		return &KRPCError{Code: krpcMessageTooBig, Message: "message (v field) too big"}
+	}
+	if len(item.Salt) > dhtMaxSaltSize {
+		return &KRPCError{Code: krpcSaltTooBig, Message: "salt (salt field) too big"}
+	}
+	return nil
+}
+
+func (item *MutableItem) Verify() error {
+	if err := item.validateSize(); err != nil {
+		return err
+	}
+	if len(item.PublicKey) != ed25519.PublicKeySize || len(item.Signature) != ed25519.SignatureSize ||
+		!ed25519.Verify(item.PublicKey, mutableSignatureData(item.Salt, item.Seq, item.Value), item.Signature) {
+		return &KRPCError{Code: krpcInvalidSignature, Message: "invalid signature"}
+	}
+	return nil
+}
+
+func mutableTarget(publicKey ed25519.PublicKey, salt []byte) NodeID {
+	return NodeID(sha1.Sum(append(append([]byte(nil), publicKey...), salt...)))
+}
+
+// mutableSignatureData is the buffer a mutable item's signature covers: the
+// bencoded salt, seq and v entries without the surrounding dictionary.
+func mutableSignatureData(salt []byte, seq int64, value []byte) []byte {
+	var data []byte
+	if len(salt) > 0 {
+		data = fmt.Appendf(data, "4:salt%d:%s", len(salt), salt)
+	}
+	data = fmt.Appendf(data, "3:seqi%de1:v", seq)
+	return append(data, value...)
+}
+
+// dhtItem is an item stored on behalf of other nodes; immutable items have
+// no public key.
+type dhtItem struct {
+	MutableItem
+	expires time.Time
+}
+
+// PutImmutable stores v in the DHT and returns the target it can be fetched
+// with, the SHA-1 of its encoding.
+func (d *DHT) PutImmutable(v any) (NodeID, error) {
+	value, err := Marshal(v)
+	if err != nil {
+		return NodeID{}, err
+	}
+	if len(value) > dhtMaxItemSize {
+		return NodeID{}, &KRPCError{Code: krpcMessageTooBig, Message: "message (v field) too big"}
+	}
+	target := NodeID(sha1.Sum(value))
+	return target, d.put(target, krpcArgs{V: value})
+}
+
+// GetImmutable fetches the item stored under target, checking that it
+// hashes to target.
+func (d *DHT) GetImmutable(target NodeID) (RawMessage, error) {
+	for _, result := range d.lookupItem(target) {
+		if value := result.response.V; value != nil && NodeID(sha1.Sum(value)) == target {
+			return value, nil
+		}
+	}
+	return nil, errors.New("item not found in the dht")
+}
+
+// PutMutable stores a signed item. With cas set, nodes only accept it if
+// the version they hold has that sequence number.
+func (d *DHT) PutMutable(item *MutableItem, cas *int64) error {
+	if err := item.Verify(); err != nil {
+		return err
+	}
+	seq := item.Seq
+	return d.put(item.Target(), krpcArgs{
+		V:    item.Value,
+		K:    item.PublicKey,
+		Sig:  item.Signature,
+		Seq:  &seq,
+		Salt: item.Salt,
+		CAS:  cas,
+	})
+}
+
+// GetMutable fetches the latest version of a mutable item that carries a
+// valid signature.
+func (d *DHT) GetMutable(publicKey ed25519.PublicKey, salt []byte) (*MutableItem, error) {
+	var latest *MutableItem
+	for _, result := range d.lookupItem(mutableTarget(publicKey, salt)) {
+		response := result.response
+		if response.V == nil || response.Seq == nil || !bytes.Equal(response.K, publicKey) {
+			continue
+		}
+		item := &MutableItem{
+			PublicKey: publicKey,
+			Salt:      salt,
+			Seq:       *response.Seq,
+			Value:     response.V,
+			Signature: response.Sig,
+		}
+		if item.Verify() != nil {
+			continue
+		}
+		if latest == nil || item.Seq > latest.Seq {
+			latest = item
+		}
+	}
+	if latest == nil {
+		return nil, errors.New("item not found in the dht")
+	}
+	return latest, nil
+}
+
+func (d *DHT) lookupItem(target NodeID) []lookupResult {
+	return d.lookup(target, nil, func(contact dhtContact) (*krpcReturn, error) {
+		return d.query(contact.Addr, "get", krpcArgs{Target: target[:]})
+	})
+}
+
+// put stores an item on the nodes closest to target that handed out a write
+// token during the lookup.
+func (d *DHT) put(target NodeID, args krpcArgs) error {
+	if d.table.Len() == 0 {
+		return errors.New("dht routing table is empty")
+	}
+	results := d.lookupItem(target)
+
+	var stored int
+	var errs []error
+	var conflict *KRPCError
+	for _, result := range results[:min(dhtBucketSize, len(results))] {
+		if result.response.Token == nil {
+			continue
+		}
+		args.Token = result.response.Token
+		if _, err := d.query(result.contact.Addr, "put", args); err != nil {
+			var krpcErr *KRPCError
+			if errors.As(err, &krpcErr) && (krpcErr.Code == krpcCASMismatch || krpcErr.Code == krpcSequenceTooLow) {
+				conflict = krpcErr
+			}
+			errs = append(errs, err)
+			continue
+		}
+		stored++
+	}
+	// A node holding a newer version means ours is stale, even if nodes that
+	// had not seen the item yet accepted it.
+	if conflict != nil {
+		return conflict
+	}
+	if stored == 0 {
+		return fmt.Errorf("no dht node stored the item: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+func (d *DHT) handleGet(args *krpcArgs, remote netip.Addr) (krpcReturn, *KRPCError) {
+	if len(args.Target) != len(NodeID{}) {
+		return krpcReturn{}, &KRPCError{Code: krpcProtocolError, Message: "invalid target"}
+	}
+	target := NodeID(args.Target)
+	response := krpcReturn{
+		Token: d.token(remote, 0),
+		Nodes: compactNodes(d.table.Closest(target, dhtBucketSize)),
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	item, ok := d.items[target]
+	if !ok || time.Now().After(item.expires) {
+		delete(d.items, target)
+		return response, nil
+	}
+	if item.PublicKey != nil {
+		seq := item.Seq
+		response.Seq = &seq
+		if args.Seq != nil && item.Seq <= *args.Seq {
+			return response, nil
+		}
+		response.K = item.PublicKey
+		response.Sig = item.Signature
+	}
+	response.V = item.Value
+	return response, nil
+}
+
+func (d *DHT) handlePut(args *krpcArgs, remote netip.Addr) (krpcReturn, *KRPCError) {
+	if !d.validToken(args.Token, remote) {
+		return krpcReturn{}, &KRPCError{Code: krpcProtocolError, Message: "invalid token"}
+	}
+	if len(args.V) == 0 {
+		return krpcReturn{}, &KRPCError{Code: krpcProtocolError, Message: "missing value"}
+	}
+	if len(args.V) > dhtMaxItemSize {
+		return krpcReturn{}, &KRPCError{Code: krpcMessageTooBig, Message: "message (v field) too big"}
+	}
+
+	item := dhtItem{
+		MutableItem: MutableItem{Value: args.V},
+		expires:     time.Now().Add(dhtItemLifetime),
+	}
+	target := NodeID(sha1.Sum(args.V))
+	if args.K != nil {
+		if args.Seq == nil {
+			return krpcReturn{}, &KRPCError{Code: krpcProtocolError, Message: "missing sequence number"}
+		}
+		item.PublicKey = args.K
+		item.Salt = args.Salt
+		item.Seq = *args.Seq
+		item.Signature = args.Sig
+		if err := item.Verify(); err != nil {
+			return krpcReturn{}, err.(*KRPCError)
+		}
+		target = item.Target()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	current, ok := d.items[target]
+	if ok && !time.Now().Before(current.expires) {
+		delete(d.items, target)
+		ok = false
+	}
+	if !ok && len(d.items) >= dhtMaxItems {
+		return krpcReturn{}, &KRPCError{Code: krpcGenericError, Message: "storage full"}
+	}
+	if ok && current.PublicKey != nil {
+		if args.CAS != nil && *args.CAS != current.Seq {
+			return krpcReturn{}, &KRPCError{Code: krpcCASMismatch, Message: "CAS mismatch, re-read value and try again"}
+		}
+		if item.Seq < current.Seq || item.Seq == current.Seq && !bytes.Equal(item.Value, current.Value) {
+			return krpcReturn{}, &KRPCError{Code: krpcSequenceTooLow, Message: "sequence number less than current"}
+		}
+	}
+	d.items[target] = item
+	return krpcReturn{}, nil
+}
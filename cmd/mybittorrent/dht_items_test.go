@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// The test vectors of BEP 44.
+func TestDHTItemTargets(t *testing.T) {
+	value := RawMessage("12:Hello World!")
+	if target := sha1.Sum(value); hex.EncodeToString(target[:]) != "e5f96f6f38320f0f33959cb4d3d656452117aadb" {
+		t.Errorf("immutable target %x", target)
+	}
+
+	publicKey := ed25519.PublicKey(mustDecodeHex(t, "77ff84905a91936367c01360803104f92432fcd904a43511876df5cdf3e7e548"))
+	tests := []struct {
+		salt      string
+		signature string
+		target    string
+	}{
+		{"", "305ac8aeb6c9c151fa120f120ea2cfb923564e11552d06a5d856091e5e853cff1260d3f39e4999684aa92eb73ffd136e6f4f3ecbfda0ce53a1608ecd7ae21f01", "4a533d47ec9c7d95b1ad75f576cffc641853b750"},
+		{"foobar", "6834284b6b24c3204eb2fea824d82f88883a3d95e8b4a21b8c0ded553d17d17ddf9a8a7104b1258f30bed3787e6cb896fca78c58f8e03b5f18f14951a87d9a08", "411eba73b6f087ca51a3795d9c8c938d365e32c1"},
+	}
+	for _, tt := range tests {
+		item := &MutableItem{
+			PublicKey: publicKey,
+			Salt:      []byte(tt.salt),
+			Seq:       1,
+			Value:     value,
+			Signature: mustDecodeHex(t, tt.signature),
+		}
+		if err := item.Verify(); err != nil {
+			t.Errorf("salt %q: %v", tt.salt, err)
+		}
+		if target := item.Target(); hex.EncodeToString(target[:]) != tt.target {
+			t.Errorf("salt %q: target %x, want %s", tt.salt, target, tt.target)
+		}
+
+		item.Seq = 2
+		var krpcErr *KRPCError
+		if err := item.Verify(); !errors.As(err, &krpcErr) || krpcErr.Code != krpcInvalidSignature {
+			t.Errorf("salt %q: signature accepted for another seq: %v", tt.salt, err)
+		}
+	}
+}
+
+func TestMutableItemLimits(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var krpcErr *KRPCError
+	_, err = newMutableItem(privateKey, nil, 1, strings.Repeat("x", dhtMaxItemSize))
+	if !errors.As(err, &krpcErr) || krpcErr.Code != krpcMessageTooBig {
+		t.Errorf("oversized value: got %v", err)
+	}
+	_, err = newMutableItem(privateKey, make([]byte, dhtMaxSaltSize+1), 1, "v")
+	if !errors.As(err, &krpcErr) || krpcErr.Code != krpcSaltTooBig {
+		t.Errorf("oversized salt: got %v", err)
+	}
+}
+
+func TestDHTHandlePut(t *testing.T) {
+	d, err := listenDHT("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	remote := netip.MustParseAddr("10.0.0.1")
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	put := func(seq int64, value string, cas *int64) *KRPCError {
+		t.Helper()
+		item, err := newMutableItem(privateKey, []byte("salt"), seq, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, krpcErr := d.handlePut(&krpcArgs{
+			Token: d.token(remote, 0),
+			V:     item.Value,
+			K:     item.PublicKey,
+			Sig:   item.Signature,
+			Seq:   &seq,
+			Salt:  item.Salt,
+			CAS:   cas,
+		}, remote)
+		return krpcErr
+	}
+	code := func(err *KRPCError) int {
+		if err == nil {
+			return 0
+		}
+		return err.Code
+	}
+	casOf := func(seq int64) *int64 { return &seq }
+
+	tests := []struct {
+		name  string
+		seq   int64
+		value string
+		cas   *int64
+		want  int
+	}{
+		{"first version", 2, "two", nil, 0},
+		{"lower seq", 1, "one", nil, krpcSequenceTooLow},
+		{"same seq, other value", 2, "other", nil, krpcSequenceTooLow},
+		{"same seq, same value", 2, "two", nil, 0},
+		{"cas mismatch", 3, "three", casOf(1), krpcCASMismatch},
+		{"cas match", 3, "three", casOf(2), 0},
+	}
+	for _, tt := range tests {
+		if got := code(put(tt.seq, tt.value, tt.cas)); got != tt.want {
+			t.Errorf("%s: got error code %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	item, _ := newMutableItem(privateKey, []byte("salt"), 4, "four")
+	seq := int64(4)
+	_, krpcErr := d.handlePut(&krpcArgs{
+		Token: d.token(remote, 0),
+		V:     item.Value,
+		K:     item.PublicKey,
+		Sig:   make([]byte, ed25519.SignatureSize),
+		Seq:   &seq,
+		Salt:  item.Salt,
+	}, remote)
+	if code(krpcErr) != krpcInvalidSignature {
+		t.Errorf("bad signature: got %v", krpcErr)
+	}
+	_, krpcErr = d.handlePut(&krpcArgs{Token: []byte("forged"), V: RawMessage("1:x")}, remote)
+	if code(krpcErr) != krpcProtocolError {
+		t.Errorf("forged token: got %v", krpcErr)
+	}
+}
+
+func TestDHTPutGet(t *testing.T) {
+	nodes := newTestDHTNetwork(t, 8)
+
+	target, err := nodes[1].PutImmutable("Hello World!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(target[:]) != "e5f96f6f38320f0f33959cb4d3d656452117aadb" {
+		t.Errorf("immutable target %x", target)
+	}
+	value, err := nodes[6].GetImmutable(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "12:Hello World!" {
+		t.Errorf("got %q", value)
+	}
+
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for seq, text := range []string{"first", "second"} {
+		item, err := newMutableItem(privateKey, nil, int64(seq+1), text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := nodes[2].PutMutable(item, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	latest, err := nodes[5].GetMutable(privateKey.Public().(ed25519.PublicKey), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.Seq != 2 || string(latest.Value) != "6:second" {
+		t.Errorf("got seq %d value %q, want the latest version", latest.Seq, latest.Value)
+	}
+
+	stale, err := newMutableItem(privateKey, nil, 1, "stale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var krpcErr *KRPCError
+	if err := nodes[3].PutMutable(stale, nil); !errors.As(err, &krpcErr) || krpcErr.Code != krpcSequenceTooLow {
+		t.Errorf("stale put: got %v, want error %d", err, krpcSequenceTooLow)
+	}
+}
+
+func TestDHTItemStoreLimits(t *testing.T) {
+	d, err := listenDHT("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	remote := netip.MustParseAddr("10.0.0.1")
+	put := func(value string) *KRPCError {
+		_, krpcErr := d.handlePut(&krpcArgs{Token: d.token(remote, 0), V: RawMessage(value)}, remote)
+		return krpcErr
+	}
+
+	if err := put("5:first"); err != nil {
+		t.Fatal(err)
+	}
+	for i := range dhtMaxItems - 1 {
+		d.items[NodeID{byte(i >> 8), byte(i), 1}] = dhtItem{expires: time.Now().Add(time.Minute)}
+	}
+	if err := put("6:second"); err == nil || err.Code != krpcGenericError {
+		t.Errorf("put to a full store: got %v, want it refused", err)
+	}
+	if err := put("5:first"); err != nil {
+		t.Errorf("refreshing a stored item: %v", err)
+	}
+
+	d.expire(time.Now().Add(2 * time.Minute))
+	if len(d.items) != 1 {
+		t.Fatalf("kept %d items, want only the one that has not expired", len(d.items))
+	}
+	if err := put("6:second"); err != nil {
+		t.Errorf("put after expired items were removed: %v", err)
+	}
+	d.expire(time.Now().Add(dhtItemLifetime + time.Second))
+	if len(d.items) != 0 {
+		t.Errorf("kept %d items after they expired", len(d.items))
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"math/bits"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// dhtBucketSize is K, the number of nodes kept per bucket and returned by
+	// lookups.
+	dhtBucketSize = 8
+	// dhtNodeStale is how long a node may stay silent before a newer node may
+	// take its place in a full bucket.
+	dhtNodeStale = 15 * time.Minute
+	// dhtMaxFailures is the number of unanswered queries after which a node
+	// is dropped.
+	dhtMaxFailures = 2
+	// dhtCompactNodeLen is the size of a node in compact node info: the ID,
+	// an IPv4 address and a port.
+	dhtCompactNodeLen = 26
+)
+
+type NodeID [20]byte
+
+func randomNodeID() NodeID {
+	var id NodeID
+	rand.Read(id[:])
+	return id
+}
+
+func (id NodeID) distance(other NodeID) NodeID {
+	var distance NodeID
+	for i := range id {
+		distance[i] = id[i] ^ other[i]
+	}
+	return distance
+}
+
+// bucketIndex is the number of leading bits id shares with other, which is
+// the index of the bucket other belongs in for a table owned by id.
+func (id NodeID) bucketIndex(other NodeID) int {
+	distance := id.distance(other)
+	for i, b := range distance {
+		if b != 0 {
+			return i*8 + bits.LeadingZeros8(b)
+		}
+	}
+	return len(id)*8 - 1
+}
+
+// dhtContact is a DHT node known by ID and address.
+type dhtContact struct {
+	ID   NodeID
+	Addr netip.AddrPort
+}
+
+func parseCompactNodes(data []byte) []dhtContact {
+	contacts := make([]dhtContact, 0, len(data)/dhtCompactNodeLen)
+	for offset := 0; offset+dhtCompactNodeLen <= len(data); offset += dhtCompactNodeLen {
+		entry := data[offset : offset+dhtCompactNodeLen]
+		addr := netip.AddrFrom4([4]byte(entry[20:24]))
+		port := binary.BigEndian.Uint16(entry[24:26])
+		if port == 0 {
+			continue
+		}
+		contacts = append(contacts, dhtContact{
+			ID:   NodeID(entry[:20]),
+			Addr: netip.AddrPortFrom(addr, port),
+		})
+	}
+	return contacts
+}
+
+func compactNodes(contacts []dhtContact) []byte {
+	data := make([]byte, 0, len(contacts)*dhtCompactNodeLen)
+	for _, contact := range contacts {
+		if !contact.Addr.Addr().Is4() {
+			continue
+		}
+		data = append(data, contact.ID[:]...)
+		data = append(data, contact.Addr.Addr().AsSlice()...)
+		data = binary.BigEndian.AppendUint16(data, contact.Addr.Port())
+	}
+	return data
+}
+
+type routingEntry struct {
+	dhtContact
+	lastSeen time.Time
+	failures int
+}
+
+// RoutingTable is a Kademlia routing table: one bucket of at most
+// dhtBucketSize nodes per length of the prefix shared with our own ID.
+type RoutingTable struct {
+	mu      sync.Mutex
+	self    NodeID
+	buckets [160][]*routingEntry
+}
+
+func newRoutingTable(self NodeID) *RoutingTable {
+	return &RoutingTable{self: self}
+}
+
+// Seen records that a node answered us or sent us a query. Known nodes are
+// refreshed; new ones are added if their bucket has room or holds a stale
+// node they can replace.
+func (t *RoutingTable) Seen(contact dhtContact) {
+	if contact.ID == t.self {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	index := t.self.bucketIndex(contact.ID)
+	bucket := t.buckets[index]
+	now := time.Now()
+	for _, entry := range bucket {
+		if entry.ID == contact.ID {
+			entry.Addr = contact.Addr
+			entry.lastSeen = now
+			entry.failures = 0
+			return
+		}
+	}
+
+	entry := &routingEntry{dhtContact: contact, lastSeen: now}
+	if len(bucket) < dhtBucketSize {
+		t.buckets[index] = append(bucket, entry)
+		return
+	}
+	oldest := slices.MinFunc(bucket, func(a, b *routingEntry) int {
+		return a.lastSeen.Compare(b.lastSeen)
+	})
+	if now.Sub(oldest.lastSeen) > dhtNodeStale {
+		*oldest = *entry
+	}
+}
+
+// Failed records an unanswered query, dropping nodes that keep failing.
+func (t *RoutingTable) Failed(id NodeID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	index := t.self.bucketIndex(id)
+	t.buckets[index] = slices.DeleteFunc(t.buckets[index], func(entry *routingEntry) bool {
+		if entry.ID != id {
+			return false
+		}
+		entry.failures++
+		return entry.failures >= dhtMaxFailures
+	})
+}
+
+// Closest returns up to count known nodes ordered by distance to target.
+func (t *RoutingTable) Closest(target NodeID, count int) []dhtContact {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var contacts []dhtContact
+	for _, bucket := range t.buckets {
+		for _, entry := range bucket {
+			contacts = append(contacts, entry.dhtContact)
+		}
+	}
+	sortByDistance(contacts, target)
+	return contacts[:min(count, len(contacts))]
+}
+
+func (t *RoutingTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var count int
+	for _, bucket := range t.buckets {
+		count += len(bucket)
+	}
+	return count
+}
+
+func sortByDistance(contacts []dhtContact, target NodeID) {
+	slices.SortFunc(contacts, func(a, b dhtContact) int {
+		da, db := target.distance(a.ID), target.distance(b.ID)
+		return bytes.Compare(da[:], db[:])
+	})
+}
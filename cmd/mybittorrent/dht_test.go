@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+)
+
+// newTestDHTNetwork starts count DHT nodes on the loopback interface, each
+// bootstrapped through the first one.
+func newTestDHTNetwork(t *testing.T, count int) []*DHT {
+	var nodes []*DHT
+	for i := range count {
+		node, err := listenDHT("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { node.Close() })
+		if i > 0 {
+			if err := node.Bootstrap([]string{nodes[0].Addr().String()}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+func testNodeID(first byte) NodeID {
+	var id NodeID
+	id[0] = first
+	return id
+}
+
+func TestNodeIDBucketIndex(t *testing.T) {
+	self := testNodeID(0)
+	tests := []struct {
+		other NodeID
+		want  int
+	}{
+		{testNodeID(0x80), 0},
+		{testNodeID(0x40), 1},
+		{testNodeID(0x01), 7},
+		{NodeID{19: 1}, 159},
+	}
+	for _, tt := range tests {
+		if got := self.bucketIndex(tt.other); got != tt.want {
+			t.Errorf("bucketIndex(%x) = %d, want %d", tt.other, got, tt.want)
+		}
+	}
+}
+
+func TestRoutingTableClosest(t *testing.T) {
+	table := newRoutingTable(testNodeID(0))
+	for _, first := range []byte{0x80, 0x10, 0x40, 0x20} {
+		table.Seen(dhtContact{ID: testNodeID(first), Addr: netip.MustParseAddrPort("10.0.0.1:6881")})
+	}
+	table.Seen(dhtContact{ID: testNodeID(0), Addr: netip.MustParseAddrPort("10.0.0.2:6881")})
+
+	var got []byte
+	for _, contact := range table.Closest(testNodeID(0x30), 3) {
+		got = append(got, contact.ID[0])
+	}
+	if want := []byte{0x20, 0x10, 0x40}; !slices.Equal(got, want) {
+		t.Errorf("closest %x, want %x", got, want)
+	}
+	if table.Len() != 4 {
+		t.Errorf("table holds %d nodes, want our own id to be left out", table.Len())
+	}
+}
+
+func TestRoutingTableBuckets(t *testing.T) {
+	table := newRoutingTable(testNodeID(0))
+	addr := netip.MustParseAddrPort("10.0.0.1:6881")
+	// every ID starting with a set bit lands in bucket 0
+	for i := range dhtBucketSize + 1 {
+		table.Seen(dhtContact{ID: NodeID{0: 0x80, 19: byte(i)}, Addr: addr})
+	}
+	if table.Len() != dhtBucketSize {
+		t.Fatalf("full bucket took a new node while none was stale: %d nodes", table.Len())
+	}
+
+	table.buckets[0][0].lastSeen = time.Now().Add(-dhtNodeStale - time.Minute)
+	newcomer := NodeID{0: 0x80, 19: 0xff}
+	table.Seen(dhtContact{ID: newcomer, Addr: addr})
+	if !slices.ContainsFunc(table.Closest(newcomer, dhtBucketSize), func(c dhtContact) bool { return c.ID == newcomer }) {
+		t.Error("stale node was not replaced")
+	}
+
+	for range dhtMaxFailures {
+		table.Failed(newcomer)
+	}
+	if table.Len() != dhtBucketSize-1 {
+		t.Errorf("node that failed %d times is still in the table", dhtMaxFailures)
+	}
+}
+
+func TestDHTAnnounceAndGetPeers(t *testing.T) {
+	nodes := newTestDHTNetwork(t, 12)
+	infoHash := []byte("01234567890123456789")
+
+	if err := nodes[3].Announce(infoHash, 7000); err != nil {
+		t.Fatal(err)
+	}
+	if err := nodes[5].Announce(infoHash, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	peers, err := nodes[len(nodes)-1].GetPeers(infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var addrs []netip.AddrPort
+	for _, peer := range peers {
+		addrs = append(addrs, peer.AddrPort())
+	}
+	for _, want := range []netip.AddrPort{
+		netip.MustParseAddrPort("127.0.0.1:7000"),
+		// implied port: the announcing node's DHT port
+		nodes[5].Addr(),
+	} {
+		if !slices.Contains(addrs, want) {
+			t.Errorf("peers %v do not include %v", addrs, want)
+		}
+	}
+}
+
+func TestDHTRejectsInvalidTokens(t *testing.T) {
+	nodes := newTestDHTNetwork(t, 2)
+	infoHash := []byte("01234567890123456789")
+	target := nodes[0].Addr()
+
+	response, err := nodes[1].query(target, "get_peers", krpcArgs{InfoHash: infoHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var krpcErr *KRPCError
+	_, err = nodes[1].query(target, "announce_peer", krpcArgs{InfoHash: infoHash, Port: 7000, Token: []byte("forged")})
+	if !errors.As(err, &krpcErr) || krpcErr.Code != krpcProtocolError {
+		t.Errorf("forged token: got %v, want a protocol error", err)
+	}
+
+	// tokens are bound to the address they were handed out to
+	other, err := listenDHT("127.0.0.2:0")
+	if err != nil {
+		t.Skip("no second loopback address:", err)
+	}
+	defer other.Close()
+	_, err = other.query(target, "announce_peer", krpcArgs{InfoHash: infoHash, Port: 7000, Token: response.Token})
+	if !errors.As(err, &krpcErr) || krpcErr.Code != krpcProtocolError {
+		t.Errorf("token of another address: got %v, want a protocol error", err)
+	}
+
+	if _, err := nodes[1].query(target, "announce_peer", krpcArgs{InfoHash: infoHash, Port: 7000, Token: response.Token}); err != nil {
+		t.Fatalf("valid token: %v", err)
+	}
+	if stored := nodes[0].storedPeers(infoHash); len(stored) != 1 || stored[0].Port() != 7000 {
+		t.Errorf("stored peers %v", stored)
+	}
+}
+
+func TestDHTTokenRotation(t *testing.T) {
+	d, err := listenDHT("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	addr := netip.MustParseAddr("10.0.0.1")
+	token := d.token(addr, 0)
+
+	d.secretRotated = time.Now().Add(-dhtTokenLifetime - time.Second)
+	d.token(addr, 0)
+	if !d.validToken(token, addr) {
+		t.Error("token from the previous secret was rejected")
+	}
+	d.secretRotated = time.Now().Add(-dhtTokenLifetime - time.Second)
+	d.token(addr, 0)
+	if d.validToken(token, addr) {
+		t.Error("token from two secrets ago was accepted")
+	}
+}
+
+func TestDHTPeerStoreLimits(t *testing.T) {
+	d, err := listenDHT("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	peerAddr := func(i int) netip.AddrPort {
+		return netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)}), 6881)
+	}
+
+	infoHash := make([]byte, 20)
+	for i := range dhtMaxTorrentPeers + 1 {
+		d.storePeer(infoHash, peerAddr(i))
+	}
+	if count := len(d.peers[string(infoHash)]); count != dhtMaxTorrentPeers || d.peerCount != dhtMaxTorrentPeers {
+		t.Errorf("stored %d peers (count %d), want %d", count, d.peerCount, dhtMaxTorrentPeers)
+	}
+	if !slices.ContainsFunc(d.peers[string(infoHash)], func(peer dhtStoredPeer) bool { return peer.addr == peerAddr(dhtMaxTorrentPeers) }) {
+		t.Error("the newest peer did not replace the oldest one")
+	}
+
+	values := d.storedPeers(infoHash)
+	if len(values) != dhtMaxValues {
+		t.Errorf("get_peers would return %d values, want %d", len(values), dhtMaxValues)
+	}
+	if again := d.storedPeers(infoHash); slices.Equal(values, again) {
+		t.Error("get_peers returns the same peers every time")
+	}
+
+	d.peerCount = dhtMaxStoredPeers
+	other := bytes.Repeat([]byte{1}, 20)
+	d.storePeer(other, peerAddr(0))
+	if len(d.peers[string(other)]) != 0 {
+		t.Error("stored a peer beyond the total limit")
+	}
+	d.peerCount = dhtMaxTorrentPeers
+
+	d.expire(time.Now().Add(dhtPeerLifetime + time.Second))
+	if len(d.peers) != 0 || d.peerCount != 0 {
+		t.Errorf("kept %d torrents and %d peers after they expired", len(d.peers), d.peerCount)
+	}
+}
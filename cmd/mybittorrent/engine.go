@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultMaxPeers is how many peers a download connects to at once.
+	defaultMaxPeers = 8
+	// peerRequestTimeout is how long a peer that has us unchoked may take to
+	// send the next block we asked for before we give up on it.
+	peerRequestTimeout = 30 * time.Second
+	// peerWaitTimeout is how long a download without any connection waits
+	// for the tracker session to deliver new peers before it gives up.
+	peerWaitTimeout = 5 * time.Minute
+)
+
+// PieceScheduler hands out the missing pieces of a download to its peer
+// connections, giving each piece to one connection at a time. The picker
+// chooses among the pieces a connection could download.
+type PieceScheduler struct {
+	mu         sync.Mutex
+	pieceCount int
+	picker     PiecePicker
+	have       Bitfield
+	inProgress map[int]bool
+	completed  []int
+	changed    chan struct{}
+}
+
+func newPieceScheduler(pieceCount int, picker PiecePicker) *PieceScheduler {
+	return &PieceScheduler{
+		pieceCount: pieceCount,
+		picker:     picker,
+		have:       newBitfield(pieceCount),
+		inProgress: make(map[int]bool),
+		changed:    make(chan struct{}),
+	}
+}
+
+// Changed returns a channel that is closed the next time a piece is
+// released or completed, to wake connections that had nothing to download.
+func (s *PieceScheduler) Changed() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.changed
+}
+
+func (s *PieceScheduler) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Next reserves a piece the peer has and nobody is downloading yet.
+func (s *PieceScheduler) Next(hasPiece func(int) bool) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	index, ok := s.picker.Pick(len(s.completed), func(index int) bool {
+		return !s.have.Has(index) && !s.inProgress[index] && hasPiece(index)
+	})
+	if ok {
+		s.inProgress[index] = true
+	}
+	return index, ok
+}
+
+// Release gives back a piece whose download was abandoned.
+func (s *PieceScheduler) Release(index int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.inProgress, index)
+	s.notify()
+}
+
+// Complete records a piece that was verified and written.
+func (s *PieceScheduler) Complete(index int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.inProgress, index)
+	if !s.have.Has(index) {
+		s.have.Set(index)
+		s.completed = append(s.completed, index)
+	}
+	s.notify()
+}
+
+// Completed returns the pieces completed after the first since ones, in the
+// order they completed, so connections can announce each of them once.
+func (s *PieceScheduler) Completed(since int) []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int(nil), s.completed[since:]...)
+}
+
+// Have returns a copy of the pieces we have.
+func (s *PieceScheduler) Have() (Bitfield, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return bytes.Clone(s.have), len(s.completed)
+}
+
+// Done reports whether every piece that is not skipped is complete.
+func (s *PieceScheduler) Done() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for index := range s.pieceCount {
+		if !s.have.Has(index) && s.picker.Priority(index) != PrioritySkip {
+			return false
+		}
+	}
+	return true
+}
+
+// pieceBuffer collects the blocks of a piece, which may arrive in any order.
+type pieceBuffer struct {
+	data      []byte
+	remaining int
+}
+
+// DownloadEngine downloads a torrent from several peers at once. It keeps up
+// to maxPeers connections open, taking new peers from the pool as
+// connections fail, and stores each piece once its hash is verified.
+type DownloadEngine struct {
+	infoHash  []byte
+	pool      *PeerPool
+	info      DownloadFileInfo
+	picker    PiecePicker
+	scheduler *PieceScheduler
+	maxPeers  int
+	peerWait  time.Duration
+
+	mu    sync.Mutex
+	conns map[*PeerConn]bool
+	done  bool
+}
+
+func newDownloadEngine(infoHash []byte, pool *PeerPool, info DownloadFileInfo, picker PiecePicker, maxPeers int) *DownloadEngine {
+	return &DownloadEngine{
+		infoHash:  infoHash,
+		pool:      pool,
+		info:      info,
+		picker:    picker,
+		scheduler: newPieceScheduler(info.storage.PieceCount(), picker),
+		maxPeers:  max(maxPeers, 1),
+		peerWait:  peerWaitTimeout,
+		conns:     make(map[*PeerConn]bool),
+	}
+}
+
+// Run downloads the torrent, starting with the given established
+// connections. It returns once every piece is stored, or with an error when
+// no peer is left to download from and the tracker session has not
+// delivered new ones for peerWait.
+func (e *DownloadEngine) Run(conns ...*PeerConn) error {
+	if err := e.info.storage.Create(); err != nil {
+		return fmt.Errorf("cannot create files: %w", err)
+	}
+
+	results := make(chan error)
+	var active int
+	// opening counts the connections still taking a peer from the pool
+	var opening atomic.Int32
+	start := func(conn *PeerConn) {
+		active++
+		go func() {
+			results <- e.runPeer(conn, 0)
+		}()
+	}
+	for _, conn := range conns {
+		start(conn)
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var errs []error
+	for !e.scheduler.Done() {
+		for range e.connectionsToOpen(active, int(opening.Load())) {
+			opening.Add(1)
+			active++
+			go func() {
+				conn, announced, err := e.connect()
+				opening.Add(-1)
+				if err != nil {
+					results <- err
+					return
+				}
+				results <- e.runPeer(conn, announced)
+			}()
+		}
+		if active == 0 {
+			if !e.waitForPeers() {
+				return fmt.Errorf("no peers left to download from: %w", errors.Join(errs...))
+			}
+			continue
+		}
+
+		select {
+		case err := <-results:
+			active--
+			// another connection may have taken the last queued peer
+			if err != nil && !errors.Is(err, errNoPeers) && !e.scheduler.Done() {
+				log.Println("peer connection ended", err)
+				errs = append(errs, err)
+			}
+		case peers := <-e.info.session.Peers():
+			e.pool.Add(peers...)
+		case <-ticker.C:
+		}
+	}
+
+	// connections still waiting for messages are closed to stop them
+	e.mu.Lock()
+	e.done = true
+	for conn := range e.conns {
+		conn.client.Close()
+	}
+	e.mu.Unlock()
+	for ; active > 0; active-- {
+		<-results
+	}
+	return nil
+}
+
+// connectionsToOpen is how many new connections to open: enough to reach
+// maxPeers, but no more than the queued peers not already being taken by a
+// connection that is opening.
+func (e *DownloadEngine) connectionsToOpen(active, opening int) int {
+	return max(min(e.maxPeers-active, e.pool.Queued()-opening), 0)
+}
+
+// waitForPeers waits up to peerWait for the tracker session to deliver
+// peers that are not known yet and reports whether it did.
+func (e *DownloadEngine) waitForPeers() bool {
+	timer := time.NewTimer(e.peerWait)
+	defer timer.Stop()
+	for {
+		select {
+		case peers := <-e.info.session.Peers():
+			if e.pool.Add(peers...) > 0 {
+				return true
+			}
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+// connect opens a connection to the next peer of the pool, performs the
+// handshake and announces the pieces we have. It also returns how many
+// completed pieces that announcement covers.
+func (e *DownloadEngine) connect() (*PeerConn, int, error) {
+	client, peer, err := e.pool.Connect()
+	if err != nil {
+		return nil, 0, err
+	}
+	have, announced := e.scheduler.Have()
+	conn, err := openPeerConn(client, peer, e.infoHash, e.pool, have)
+	if err != nil {
+		client.Close()
+		e.pool.Disconnected(peer)
+		return nil, 0, fmt.Errorf("%s: %w", peer, err)
+	}
+	return conn, announced, nil
+}
+
+func (e *DownloadEngine) track(conn *PeerConn) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.done {
+		return false
+	}
+	e.conns[conn] = true
+	return true
+}
+
+func (e *DownloadEngine) untrack(conn *PeerConn) {
+	e.mu.Lock()
+	delete(e.conns, conn)
+	e.mu.Unlock()
+	conn.Close()
+	e.pool.Disconnected(conn.peer)
+	if conn.picker != nil {
+		e.picker.RemoveBitfield(conn.bitfield)
+	}
+}
+
+// runPeer downloads from one peer until the download completes or the
+// connection fails. Pieces are only reserved while the peer has us
+// unchoked, and go back to the scheduler when it chokes us, stops sending
+// blocks or the connection ends. announced is how many completed pieces
+// the bitfield sent when connecting covered.
+func (e *DownloadEngine) runPeer(conn *PeerConn, announced int) error {
+	if !e.track(conn) {
+		conn.client.Close()
+		return nil
+	}
+	defer e.untrack(conn)
+
+	pieceCount := e.info.storage.PieceCount()
+	conn.picker = e.picker
+	if err := conn.SetPieceCount(pieceCount); err != nil {
+		return fmt.Errorf("%s: %w", conn.peer, err)
+	}
+	if err := conn.SetInterested(true); err != nil {
+		return fmt.Errorf("%s: %w", conn.peer, err)
+	}
+
+	pieces := make(map[int]*pieceBuffer)
+	release := func() {
+		for index := range pieces {
+			delete(pieces, index)
+			e.scheduler.Release(index)
+		}
+	}
+	defer release()
+
+	incoming := conn.Incoming()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	lastBlock := time.Now()
+	for !e.scheduler.Done() {
+		for _, index := range e.scheduler.Completed(announced) {
+			if err := conn.SendHave(index); err != nil {
+				return fmt.Errorf("%s: %w", conn.peer, err)
+			}
+			announced++
+		}
+
+		// taken before reserving, so a piece released meanwhile is not missed
+		changed := e.scheduler.Changed()
+		if conn.Choked() {
+			// a peer drops the requests of the peers it chokes
+			release()
+			conn.DropRequests()
+		} else {
+			if len(pieces) == 0 {
+				lastBlock = time.Now()
+			}
+			for conn.Outstanding() < conn.Window() {
+				index, ok := e.scheduler.Next(conn.HasPiece)
+				if !ok {
+					break
+				}
+				requests := blockRequests(index, e.info.storage.PieceSize(index))
+				pieces[index] = &pieceBuffer{
+					data:      make([]byte, e.info.storage.PieceSize(index)),
+					remaining: len(requests),
+				}
+				if err := conn.Request(requests...); err != nil {
+					return fmt.Errorf("%s: %w", conn.peer, err)
+				}
+			}
+		}
+
+		var read peerRead
+		select {
+		case read = <-incoming:
+		case <-changed:
+			continue
+		case <-ticker.C:
+			if len(pieces) > 0 && time.Since(lastBlock) > peerRequestTimeout {
+				return fmt.Errorf("%s: no block received for %s", conn.peer, peerRequestTimeout)
+			}
+			if err := conn.SendPex(); err != nil {
+				return fmt.Errorf("%s: %w", conn.peer, err)
+			}
+			continue
+		}
+		if read.err != nil {
+			return fmt.Errorf("%s: %w", conn.peer, read.err)
+		}
+		request, block, err := conn.Receive(read.msg)
+		if err != nil {
+			return fmt.Errorf("%s: %w", conn.peer, err)
+		}
+		index := int(request.index)
+		piece, ok := pieces[index]
+		if block == nil || !ok {
+			continue
+		}
+		lastBlock = time.Now()
+		copy(piece.data[request.begin:], block)
+		e.info.session.AddDownloaded(len(block))
+		if piece.remaining--; piece.remaining > 0 {
+			continue
+		}
+		delete(pieces, index)
+
+		if err := e.info.verifier.Verify(index, piece.data); err != nil {
+			e.scheduler.Release(index)
+			return fmt.Errorf("%s: %w", conn.peer, err)
+		}
+		if err := e.info.storage.WritePiece(index, piece.data); err != nil {
+			e.scheduler.Release(index)
+			return err
+		}
+		e.scheduler.Complete(index)
+		e.info.session.AddVerified(len(piece.data))
+		fmt.Printf("Piece %d/%d downloaded from %s\n", index, pieceCount-1, conn.peer)
+	}
+	return nil
+}
+
+// openPeerConn performs the handshake on a new connection and sends our
+// bitfield. Extension support is announced in the handshake, and the
+// extension handshake is sent to peers that support it.
+func openPeerConn(client *TCPClient, peer Peer, infoHash []byte, pool *PeerPool, have Bitfield) (*PeerConn, error) {
+	if _, err := client.Write(createHandshakePacket(infoHash, true)); err != nil {
+		return nil, fmt.Errorf("unable to write all data to socket: %w", err)
+	}
+	handshake, err := client.ReadHandshake()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(handshake.InfoHash[:], infoHash) {
+		return nil, errors.New("peer answered with another info hash")
+	}
+	fmt.Printf("Connected to %s, Peer ID: %x\n", peer, handshake.PeerID)
+
+	conn := newPeerConn(client)
+	conn.peer = peer
+	conn.pool = pool
+	if err := conn.SendBitfield(have); err != nil {
+		return nil, err
+	}
+	if handshake.SupportsExtensions() {
+		msg, err := newExtensionHandshakePacket()
+		if err != nil {
+			return nil, err
+		}
+		if err := client.WriteMessage(msg); err != nil {
+			return nil, err
+		}
+	}
+	return conn, nil
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSeeder is a peer that has every piece of data and serves it to
+// anyone. It can be told to keep us choked, to corrupt the blocks it sends,
+// or to go quiet and close the connection after a number of blocks. With pex
+// set it supports peer exchange and records the peers it is told about.
+type fakeSeeder struct {
+	data     []byte
+	pieceLen int
+
+	choking    bool
+	pex        bool
+	corrupt    bool
+	closeAfter int
+	pause      time.Duration
+	delay      time.Duration
+
+	ln       net.Listener
+	mu       sync.Mutex
+	requests int
+	served   int
+	exchange []Peer
+}
+
+func (s *fakeSeeder) peer() Peer {
+	addr := s.ln.Addr().(*net.TCPAddr).AddrPort()
+	return Peer{Addr: addr.Addr(), Port: addr.Port()}
+}
+
+func (s *fakeSeeder) counts() (requests, served int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests, s.served
+}
+
+func (s *fakeSeeder) exchanged() []Peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.exchange)
+}
+
+func (s *fakeSeeder) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := NewMessageReader(conn)
+	handshake, err := reader.ReadHandshake()
+	if err != nil {
+		return
+	}
+	reply := createHandshakePacket(handshake.InfoHash[:], s.pex)
+	conn.Write(reply)
+
+	pieceCount := (len(s.data) + s.pieceLen - 1) / s.pieceLen
+	bitfield := newBitfield(pieceCount)
+	for index := range pieceCount {
+		bitfield.Set(index)
+	}
+	send := func(id byte, payload []byte) error {
+		msg := PeerMessage{id: id, payload: payload}
+		_, err := conn.Write(msg.serialize())
+		return err
+	}
+	send(msgBitfield, bitfield)
+	if s.pex {
+		handshake, _ := newExtendedMessage(0, ExtensionHandshake{M: map[string]int{"ut_pex": 1}})
+		conn.Write(handshake.serialize())
+	}
+
+	var served int
+	for {
+		msg, err := reader.ReadMessage()
+		if err != nil {
+			return
+		}
+		if msg.keepAlive {
+			continue
+		}
+		switch msg.id {
+		case msgExtended:
+			if len(msg.payload) == 0 || msg.payload[0] != 1 {
+				continue
+			}
+			added, _, err := parsePexMessage(msg.payload[1:])
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.exchange = append(s.exchange, added...)
+			s.mu.Unlock()
+		case msgInterested:
+			if !s.choking {
+				send(msgUnchoke, nil)
+			}
+		case msgRequest:
+			s.mu.Lock()
+			s.requests++
+			s.mu.Unlock()
+			if s.choking {
+				continue
+			}
+			index := binary.BigEndian.Uint32(msg.payload[0:4])
+			begin := binary.BigEndian.Uint32(msg.payload[4:8])
+			length := binary.BigEndian.Uint32(msg.payload[8:12])
+			offset := int(index)*s.pieceLen + int(begin)
+			block := bytes.Clone(s.data[offset : offset+int(length)])
+			if s.corrupt {
+				block[0] ^= 0xff
+			}
+			time.Sleep(s.delay)
+			if err := send(msgPiece, append(msg.payload[:8:8], block...)); err != nil {
+				return
+			}
+			served++
+			s.mu.Lock()
+			s.served++
+			s.mu.Unlock()
+			if served == s.closeAfter {
+				time.Sleep(s.pause)
+				return
+			}
+		}
+	}
+}
+
+type engineFixture struct {
+	data []byte
+	info Info
+}
+
+func newEngineFixture(t *testing.T, size, pieceLen int) *engineFixture {
+	data := make([]byte, size)
+	rand.Read(data)
+	var pieces []byte
+	for offset := 0; offset < size; offset += pieceLen {
+		hash := sha1.Sum(data[offset:min(offset+pieceLen, size)])
+		pieces = append(pieces, hash[:]...)
+	}
+	return &engineFixture{
+		data: data,
+		info: Info{Name: "data.bin", Length: size, PieceLength: pieceLen, Pieces: pieces},
+	}
+}
+
+func (f *engineFixture) seeder(t *testing.T, configure func(*fakeSeeder)) *fakeSeeder {
+	t.Helper()
+	s := &fakeSeeder{data: f.data, pieceLen: f.info.PieceLength}
+	if configure != nil {
+		configure(s)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s.ln = ln
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// download runs an engine against the seeders and checks the data it wrote.
+func (f *engineFixture) download(t *testing.T, maxPeers int, seeders ...*fakeSeeder) {
+	t.Helper()
+	got := f.run(t, nil, maxPeers, seeders...)
+	if !bytes.Equal(got, f.data) {
+		t.Fatal("downloaded data does not match")
+	}
+}
+
+// run downloads from the seeders with picker, or a rarest first picker when
+// it is nil, and returns the data written.
+func (f *engineFixture) run(t *testing.T, picker PiecePicker, maxPeers int, seeders ...*fakeSeeder) []byte {
+	t.Helper()
+	engine, output := f.engine(t, picker, maxPeers, seeders...)
+	return f.wait(t, engine, output)
+}
+
+// engine returns an engine that downloads from the seeders to output.
+func (f *engineFixture) engine(t *testing.T, picker PiecePicker, maxPeers int, seeders ...*fakeSeeder) (engine *DownloadEngine, output string) {
+	t.Helper()
+	output = filepath.Join(t.TempDir(), f.info.Name)
+	storage, err := newStorage(output, &f.info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := newPieceVerifier(&f.info, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metainfo := &Metainfo{Info: f.info, InfoHash: bytes.Repeat([]byte{0x42}, 20)}
+	var peers []Peer
+	for _, s := range seeders {
+		peers = append(peers, s.peer())
+	}
+	if picker == nil {
+		picker = newRarestFirstPicker(storage.PieceCount())
+	}
+	engine = newDownloadEngine(metainfo.InfoHash, newPeerPool(peers), DownloadFileInfo{
+		storage:  storage,
+		verifier: verifier,
+		session:  newTrackerSession(metainfo),
+	}, picker, maxPeers)
+	return engine, output
+}
+
+// wait runs the engine and returns the data it wrote.
+func (f *engineFixture) wait(t *testing.T, engine *DownloadEngine, output string) []byte {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- engine.Run() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("download did not finish")
+	}
+
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestPieceSchedulerWakesOnRelease(t *testing.T) {
+	scheduler := newPieceScheduler(2, newRarestFirstPicker(2))
+	all := func(int) bool { return true }
+	first, _ := scheduler.Next(all)
+	second, _ := scheduler.Next(all)
+	changed := scheduler.Changed()
+	if _, ok := scheduler.Next(all); ok {
+		t.Fatal("reserved a piece twice")
+	}
+
+	scheduler.Release(first)
+	select {
+	case <-changed:
+	default:
+		t.Fatal("release did not wake waiting connections")
+	}
+	if index, ok := scheduler.Next(all); !ok || index != first {
+		t.Fatalf("got piece %d, %v after release, want %d", index, ok, first)
+	}
+
+	changed = scheduler.Changed()
+	scheduler.Complete(second)
+	select {
+	case <-changed:
+	default:
+		t.Fatal("completion did not wake waiting connections")
+	}
+}
+
+// A seeder that goes quiet in the middle of a piece and then disconnects
+// leaves the piece to a peer that had run out of work by then and never
+// sends have messages.
+func TestDownloadEngineRecoversFromDisconnect(t *testing.T) {
+	f := newEngineFixture(t, 12*4*blockSize, 4*blockSize)
+	flaky := f.seeder(t, func(s *fakeSeeder) {
+		s.closeAfter = 6
+		s.pause = 300 * time.Millisecond
+	})
+	good := f.seeder(t, func(s *fakeSeeder) { s.delay = 2 * time.Millisecond })
+	f.download(t, 2, flaky, good)
+
+	if _, served := flaky.counts(); served != 6 {
+		t.Errorf("flaky seeder served %d blocks, want 6", served)
+	}
+}
+
+func TestDownloadEngineSkipsChokingPeer(t *testing.T) {
+	f := newEngineFixture(t, 8*2*blockSize, 2*blockSize)
+	choking := f.seeder(t, func(s *fakeSeeder) { s.choking = true })
+	good := f.seeder(t, nil)
+	f.download(t, 2, choking, good)
+
+	if requests, _ := choking.counts(); requests != 0 {
+		t.Errorf("sent %d requests to a peer that chokes us", requests)
+	}
+}
+
+func TestDownloadEngineRejectsCorruptPieces(t *testing.T) {
+	f := newEngineFixture(t, 8*2*blockSize, 2*blockSize)
+	corrupt := f.seeder(t, func(s *fakeSeeder) { s.corrupt = true })
+	good := f.seeder(t, func(s *fakeSeeder) { s.delay = 2 * time.Millisecond })
+	f.download(t, 2, corrupt, good)
+
+	if _, served := corrupt.counts(); served == 0 {
+		t.Error("corrupt seeder was never asked for a block")
+	}
+}
+
+func TestDownloadEngineSkipsPieces(t *testing.T) {
+	f := newEngineFixture(t, 8*blockSize, blockSize)
+	seeder := f.seeder(t, nil)
+	picker := newRarestFirstPicker(8)
+	for index := range 4 {
+		picker.SetPriority(index, PrioritySkip)
+	}
+	got := f.run(t, picker, 1, seeder)
+
+	if requests, _ := seeder.counts(); requests != 4 {
+		t.Errorf("requested %d blocks, want the 4 pieces not skipped", requests)
+	}
+	if !bytes.Equal(got[4*blockSize:], f.data[4*blockSize:]) {
+		t.Error("downloaded data does not match")
+	}
+	if !bytes.Equal(got[:4*blockSize], make([]byte, 4*blockSize)) {
+		t.Error("skipped pieces were written")
+	}
+}
+
+// A peer that keeps us choked sends nothing after its handshakes, so it only
+// learns about peers we connect to later from the periodic update.
+func TestDownloadEngineSendsPexToQuietPeers(t *testing.T) {
+	f := newEngineFixture(t, 16*blockSize, blockSize)
+	quiet := f.seeder(t, func(s *fakeSeeder) {
+		s.choking = true
+		s.pex = true
+	})
+	good := f.seeder(t, func(s *fakeSeeder) { s.delay = 150 * time.Millisecond })
+	engine, output := f.engine(t, nil, 2, quiet)
+	time.AfterFunc(100*time.Millisecond, func() { engine.pool.Add(good.peer()) })
+	if got := f.wait(t, engine, output); !bytes.Equal(got, f.data) {
+		t.Fatal("downloaded data does not match")
+	}
+
+	if exchanged := quiet.exchanged(); !slices.ContainsFunc(exchanged, func(peer Peer) bool { return peer.AddrPort() == good.peer().AddrPort() }) {
+		t.Errorf("quiet peer was told about %v, want %v", exchanged, good.peer())
+	}
+}
+
+func TestDownloadEngineConnectionsToOpen(t *testing.T) {
+	f := newEngineFixture(t, 2*blockSize, blockSize)
+	engine, _ := f.engine(t, nil, 8)
+	engine.pool.Add(
+		Peer{Addr: netip.MustParseAddr("10.0.0.1"), Port: 6881},
+		Peer{Addr: netip.MustParseAddr("10.0.0.2"), Port: 6881},
+	)
+	tests := []struct {
+		active, opening, want int
+	}{
+		{0, 0, 2},
+		{0, 1, 1},
+		{1, 2, 0},
+		{7, 0, 1},
+		{8, 0, 0},
+	}
+	for _, tt := range tests {
+		if got := engine.connectionsToOpen(tt.active, tt.opening); got != tt.want {
+			t.Errorf("%d active, %d opening: open %d connections, want %d", tt.active, tt.opening, got, tt.want)
+		}
+	}
+}
+
+func TestDownloadEngineWaitsForSessionPeers(t *testing.T) {
+	f := newEngineFixture(t, 4*blockSize, blockSize)
+	good := f.seeder(t, nil)
+	engine, output := f.engine(t, nil, 2)
+	time.AfterFunc(200*time.Millisecond, func() { engine.info.session.deliver([]Peer{good.peer()}) })
+	if got := f.wait(t, engine, output); !bytes.Equal(got, f.data) {
+		t.Fatal("downloaded data does not match")
+	}
+}
+
+func TestDownloadEngineGivesUpWithoutPeers(t *testing.T) {
+	f := newEngineFixture(t, 4*blockSize, blockSize)
+	engine, _ := f.engine(t, nil, 2)
+	engine.peerWait = 50 * time.Millisecond
+	if err := engine.Run(); err == nil || !strings.Contains(err.Error(), "no peers left") {
+		t.Fatalf("got %v, want no peers left", err)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// utMetadataID is the extended message id we ask peers to use when sending us
+// ut_metadata messages.
+const utMetadataID = 42
+
+// ExtensionHandshake is the payload of the extended handshake (BEP 10).
+type ExtensionHandshake struct {
+	M            map[string]int `bencode:"m,required"`
+	MetadataSize int            `bencode:"metadata_size,omitempty"`
+}
+
+// MetadataMessage is the dictionary at the start of a ut_metadata message
+// (BEP 9). Data messages are followed by the metadata piece itself.
+type MetadataMessage struct {
+	MsgType   int `bencode:"msg_type,required"`
+	Piece     int `bencode:"piece,required"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+func newExtendedMessage(extensionID byte, payload any) (PeerMessage, error) {
+	encoded, err := Marshal(payload)
+	if err != nil {
+		return PeerMessage{}, fmt.Errorf("unable to encode extended message: %w", err)
+	}
+	return PeerMessage{
+		id:      msgExtended,
+		payload: append([]byte{extensionID}, encoded...),
+	}, nil
+}
+
+func newExtensionHandshakePacket() (PeerMessage, error) {
+	return newExtendedMessage(0, ExtensionHandshake{
+		M: map[string]int{
+			"ut_metadata": utMetadataID,
+			"ut_pex":      utPexID,
+		},
+	})
+}
+
+func newMetadataRequestPacket(extensionID int, piece int) (PeerMessage, error) {
+	return newExtendedMessage(byte(extensionID), MetadataMessage{
+		MsgType: 0,
+		Piece:   piece,
+	})
+}
+
+func parseExtensionHandshake(payload []byte) (ExtensionHandshake, error) {
+	var handshake ExtensionHandshake
+	if err := Unmarshal(payload, &handshake); err != nil {
+		return ExtensionHandshake{}, fmt.Errorf("invalid extension handshake: %w", err)
+	}
+	return handshake, nil
+}
+
+// parseMetadataMessage decodes a ut_metadata message and returns the metadata
+// piece that follows its dictionary, if any.
+func parseMetadataMessage(payload []byte) (MetadataMessage, []byte, error) {
+	var msg MetadataMessage
+	decoder := NewDecoder(bytes.NewReader(payload))
+	if err := decoder.DecodeInto(&msg); err != nil {
+		return MetadataMessage{}, nil, fmt.Errorf("invalid metadata message: %w", err)
+	}
+	if msg.MsgType == 2 {
+		return msg, nil, fmt.Errorf("peer rejected metadata request for piece %d", msg.Piece)
+	}
+	return msg, payload[decoder.Offset():], nil
+}
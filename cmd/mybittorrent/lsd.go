@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// lsdAnnounceInterval is the minimum time between two announces of the
+	// same torrent, to avoid multicast storms (BEP 14).
+	lsdAnnounceInterval = time.Minute
+	// lsdLookupTimeout is how long a command listens for peers on the local
+	// network.
+	lsdLookupTimeout = 3 * time.Second
+)
+
+// Multicast groups local service discovery announces are sent to.
+var (
+	lsdGroup4 = netip.MustParseAddrPort("239.192.152.143:6771")
+	lsdGroup6 = netip.MustParseAddrPort("[ff15::efc0:988f]:6771")
+)
+
+// LSDAnnounce is a BT-SEARCH message: a peer on the local network listening
+// on Port that has the torrents of InfoHashes. Cookie lets a client recognise
+// its own announces when they are looped back.
+type LSDAnnounce struct {
+	Port       uint16
+	InfoHashes [][]byte
+	Cookie     string
+}
+
+func (a *LSDAnnounce) marshal(group netip.AddrPort) []byte {
+	var b bytes.Buffer
+	b.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(&b, "Host: %s\r\n", group)
+	fmt.Fprintf(&b, "Port: %d\r\n", a.Port)
+	for _, infoHash := range a.InfoHashes {
+		fmt.Fprintf(&b, "Infohash: %x\r\n", infoHash)
+	}
+	if a.Cookie != "" {
+		fmt.Fprintf(&b, "cookie: %s\r\n", a.Cookie)
+	}
+	b.WriteString("\r\n\r\n")
+	return b.Bytes()
+}
+
+func parseLSDAnnounce(data []byte) (*LSDAnnounce, error) {
+	reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(data)))
+	line, err := reader.ReadLine()
+	if err != nil {
+		return nil, fmt.Errorf("invalid lsd announce: %w", err)
+	}
+	if line != "BT-SEARCH * HTTP/1.1" {
+		return nil, fmt.Errorf("invalid lsd announce: unexpected request line %q", line)
+	}
+	header, err := reader.ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return nil, fmt.Errorf("invalid lsd announce: %w", err)
+	}
+
+	port, err := strconv.ParseUint(header.Get("Port"), 10, 16)
+	if err != nil || port == 0 {
+		return nil, fmt.Errorf("invalid lsd announce port %q", header.Get("Port"))
+	}
+	announce := &LSDAnnounce{
+		Port:   uint16(port),
+		Cookie: header.Get("Cookie"),
+	}
+	for _, value := range header.Values("Infohash") {
+		infoHash, err := hex.DecodeString(strings.TrimSpace(value))
+		if err != nil || len(infoHash) != 20 {
+			continue
+		}
+		announce.InfoHashes = append(announce.InfoHashes, infoHash)
+	}
+	if len(announce.InfoHashes) == 0 {
+		return nil, errors.New("invalid lsd announce: no info hash")
+	}
+	return announce, nil
+}
+
+// LSD is a local service discovery node (BEP 14). It announces torrents to a
+// multicast group and collects the peers that announce the torrents it
+// watches.
+type LSD struct {
+	conn   net.PacketConn
+	sender net.PacketConn
+	group  netip.AddrPort
+	port   uint16
+	cookie string
+
+	mu        sync.Mutex
+	peers     map[string]map[netip.AddrPort]Peer
+	announced map[string]time.Time
+}
+
+// listenLSD joins the multicast group on the default interface. Announces
+// are sent from a separate socket, as the group socket has multicast
+// loopback disabled and other clients on this host would not see them.
+func listenLSD(group netip.AddrPort) (*LSD, error) {
+	network := "udp4"
+	if group.Addr().Is6() {
+		network = "udp6"
+	}
+	conn, err := net.ListenMulticastUDP(network, nil, net.UDPAddrFromAddrPort(group))
+	if err != nil {
+		return nil, fmt.Errorf("unable to join lsd group %s: %w", group, err)
+	}
+	sender, err := net.ListenPacket(network, ":0")
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to open lsd socket: %w", err)
+	}
+	l := newLSD(conn, group, listenPort)
+	l.sender = sender
+	return l, nil
+}
+
+// newLSD runs local service discovery over conn, sending announces to group.
+func newLSD(conn net.PacketConn, group netip.AddrPort, port uint16) *LSD {
+	cookie := make([]byte, 8)
+	rand.Read(cookie)
+	l := &LSD{
+		conn:      conn,
+		sender:    conn,
+		group:     group,
+		port:      port,
+		cookie:    hex.EncodeToString(cookie),
+		peers:     make(map[string]map[netip.AddrPort]Peer),
+		announced: make(map[string]time.Time),
+	}
+	go l.serve()
+	return l
+}
+
+func (l *LSD) Close() error {
+	if l.sender != l.conn {
+		l.sender.Close()
+	}
+	return l.conn.Close()
+}
+
+// Watch makes the node collect the peers that announce infoHash.
+func (l *LSD) Watch(infoHash []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.peers[string(infoHash)] == nil {
+		l.peers[string(infoHash)] = make(map[netip.AddrPort]Peer)
+	}
+}
+
+// Peers returns the peers seen announcing a watched torrent.
+func (l *LSD) Peers(infoHash []byte) []Peer {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var peers []Peer
+	for _, peer := range l.peers[string(infoHash)] {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// Announce tells the local network we have the given torrents. Torrents
+// announced less than lsdAnnounceInterval ago are left out.
+func (l *LSD) Announce(infoHashes ...[]byte) error {
+	now := time.Now()
+	announce := LSDAnnounce{Port: l.port, Cookie: l.cookie}
+	l.mu.Lock()
+	for _, infoHash := range infoHashes {
+		if last, ok := l.announced[string(infoHash)]; ok && now.Sub(last) < lsdAnnounceInterval {
+			continue
+		}
+		l.announced[string(infoHash)] = now
+		announce.InfoHashes = append(announce.InfoHashes, infoHash)
+	}
+	l.mu.Unlock()
+	if len(announce.InfoHashes) == 0 {
+		return nil
+	}
+
+	_, err := l.sender.WriteTo(announce.marshal(l.group), net.UDPAddrFromAddrPort(l.group))
+	if err != nil {
+		return fmt.Errorf("unable to send lsd announce: %w", err)
+	}
+	return nil
+}
+
+func (l *LSD) serve() {
+	buffer := make([]byte, 64*1024)
+	for {
+		read, addr, err := l.conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		announce, err := parseLSDAnnounce(buffer[:read])
+		if err != nil || announce.Cookie == l.cookie {
+			continue
+		}
+		l.handleAnnounce(announce, udpAddr.AddrPort().Addr().Unmap())
+	}
+}
+
+// handleAnnounce records the sender as a peer of the torrents we watch and
+// answers with our own announce, so that a node that just joined does not
+// have to wait for our next periodic one.
+func (l *LSD) handleAnnounce(announce *LSDAnnounce, addr netip.Addr) {
+	peer := Peer{Addr: addr, Port: announce.Port}
+	var shared [][]byte
+	l.mu.Lock()
+	for _, infoHash := range announce.InfoHashes {
+		if peers, ok := l.peers[string(infoHash)]; ok {
+			peers[peer.AddrPort()] = peer
+			shared = append(shared, infoHash)
+		}
+	}
+	l.mu.Unlock()
+
+	if len(shared) > 0 {
+		if err := l.Announce(shared...); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// lsdEnabled reports whether commands look for peers on the local network,
+// which is opt-in through BITTORRENT_LSD and never done when all traffic must
+// go through a proxy.
+func lsdEnabled() bool {
+	if os.Getenv("BITTORRENT_LSD") == "" {
+		return false
+	}
+	dialer, err := proxyDialer()
+	return err == nil && !(dialer.URL != nil && dialer.Only)
+}
+
+// joinLSD joins the IPv4 and IPv6 groups, watches the torrent and announces
+// it. It fails only if neither group could be used.
+func joinLSD(infoHash []byte) ([]*LSD, error) {
+	var nodes []*LSD
+	var errs []error
+	for _, group := range []netip.AddrPort{lsdGroup4, lsdGroup6} {
+		l, err := listenLSD(group)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		l.Watch(infoHash)
+		if err := l.Announce(infoHash); err != nil {
+			l.Close()
+			errs = append(errs, err)
+			continue
+		}
+		nodes = append(nodes, l)
+	}
+	if len(nodes) == 0 {
+		return nil, errors.Join(errs...)
+	}
+	return nodes, nil
+}
+
+// getPeersFromLSD announces the torrent on the local network and returns the
+// peers heard from before the lookup timeout.
+func getPeersFromLSD(infoHash []byte) ([]Peer, error) {
+	nodes, err := joinLSD(infoHash)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, l := range nodes {
+			l.Close()
+		}
+	}()
+
+	time.Sleep(lsdLookupTimeout)
+	var peers []Peer
+	for _, l := range nodes {
+		peers = append(peers, l.Peers(infoHash)...)
+	}
+	return peers, nil
+}
+
+// withLocalPeers runs lookup while listening for peers on the local network,
+// if enabled, and puts the local peers first in the result.
+func withLocalPeers(infoHash []byte, lookup func() ([]Peer, error)) ([]Peer, error) {
+	if !lsdEnabled() {
+		return lookup()
+	}
+
+	type result struct {
+		peers []Peer
+		err   error
+	}
+	local := make(chan result, 1)
+	go func() {
+		peers, err := getPeersFromLSD(infoHash)
+		local <- result{peers, err}
+	}()
+
+	peers, err := lookup()
+	lan := <-local
+	if lan.err != nil {
+		log.Println("local service discovery failed", lan.err)
+	}
+	if len(lan.peers) == 0 {
+		return peers, err
+	}
+	return mergePeers(lan.peers, peers), nil
+}
+
+// mergePeers concatenates the lists, keeping the first of duplicate peers.
+func mergePeers(lists ...[]Peer) []Peer {
+	seen := make(map[netip.AddrPort]bool)
+	var merged []Peer
+	for _, peers := range lists {
+		for _, peer := range peers {
+			if !seen[peer.AddrPort()] {
+				seen[peer.AddrPort()] = true
+				merged = append(merged, peer)
+			}
+		}
+	}
+	return merged
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestLSDAnnounceRoundTrip(t *testing.T) {
+	announce := LSDAnnounce{
+		Port:       6881,
+		InfoHashes: [][]byte{bytes.Repeat([]byte{0xab}, 20), bytes.Repeat([]byte{0x01}, 20)},
+		Cookie:     "c00k1e",
+	}
+	parsed, err := parseLSDAnnounce(announce.marshal(lsdGroup4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Port != announce.Port || parsed.Cookie != announce.Cookie || len(parsed.InfoHashes) != 2 {
+		t.Fatalf("got %+v, want %+v", parsed, announce)
+	}
+	for i, infoHash := range announce.InfoHashes {
+		if !bytes.Equal(parsed.InfoHashes[i], infoHash) {
+			t.Errorf("info hash %d: got %x, want %x", i, parsed.InfoHashes[i], infoHash)
+		}
+	}
+}
+
+func TestParseLSDAnnounce(t *testing.T) {
+	infoHash := "0123456789abcdef0123456789abcdef01234567"
+	tests := []struct {
+		name    string
+		message string
+		hashes  int
+	}{
+		{"valid", "BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nPort: 6881\r\nInfohash: " + infoHash + "\r\n\r\n\r\n", 1},
+		{"lower case headers", "BT-SEARCH * HTTP/1.1\r\nport: 6881\r\ninfohash: " + infoHash + "\r\n\r\n", 1},
+		{"bad hashes skipped", "BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\nInfohash: abcd\r\nInfohash: " + infoHash + "\r\n\r\n", 1},
+		{"other request", "M-SEARCH * HTTP/1.1\r\nPort: 6881\r\nInfohash: " + infoHash + "\r\n\r\n", 0},
+		{"missing port", "BT-SEARCH * HTTP/1.1\r\nInfohash: " + infoHash + "\r\n\r\n", 0},
+		{"zero port", "BT-SEARCH * HTTP/1.1\r\nPort: 0\r\nInfohash: " + infoHash + "\r\n\r\n", 0},
+		{"no valid hash", "BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\nInfohash: xyz\r\n\r\n", 0},
+	}
+	for _, tt := range tests {
+		announce, err := parseLSDAnnounce([]byte(tt.message))
+		switch {
+		case tt.hashes == 0 && err == nil:
+			t.Errorf("%s: accepted %+v", tt.name, announce)
+		case tt.hashes > 0 && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.hashes > 0 && len(announce.InfoHashes) != tt.hashes:
+			t.Errorf("%s: got %d info hashes, want %d", tt.name, len(announce.InfoHashes), tt.hashes)
+		}
+	}
+}
+
+func listenLoopbackUDP(t *testing.T) (net.PacketConn, netip.AddrPort) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, conn.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+// newLoopbackLSD runs a node on a unicast loopback socket. Its announces go
+// to group instead of a multicast group.
+func newLoopbackLSD(t *testing.T, conn net.PacketConn, group netip.AddrPort, port uint16) *LSD {
+	l := newLSD(conn, group, port)
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func waitForLSDPeers(l *LSD, infoHash []byte, count int) []Peer {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		peers := l.Peers(infoHash)
+		if len(peers) >= count || time.Now().After(deadline) {
+			return peers
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLSDLoopback(t *testing.T) {
+	watched := bytes.Repeat([]byte{1}, 20)
+	other := bytes.Repeat([]byte{2}, 20)
+
+	connA, addrA := listenLoopbackUDP(t)
+	connB, addrB := listenLoopbackUDP(t)
+	a := newLoopbackLSD(t, connA, addrB, 7001)
+	b := newLoopbackLSD(t, connB, addrA, 7002)
+	a.Watch(watched)
+	b.Watch(watched)
+
+	// b announces both torrents; a only records the one it watches and
+	// answers with its own announce, so b learns about a without waiting.
+	if err := b.Announce(watched, other); err != nil {
+		t.Fatal(err)
+	}
+	peers := waitForLSDPeers(a, watched, 1)
+	if len(peers) != 1 || peers[0].AddrPort() != netip.MustParseAddrPort("127.0.0.1:7002") {
+		t.Fatalf("a saw peers %v, want 127.0.0.1:7002", peers)
+	}
+	if peers := a.Peers(other); len(peers) != 0 {
+		t.Errorf("a recorded peers %v for a torrent it does not watch", peers)
+	}
+	peers = waitForLSDPeers(b, watched, 1)
+	if len(peers) != 1 || peers[0].AddrPort() != netip.MustParseAddrPort("127.0.0.1:7001") {
+		t.Fatalf("b saw peers %v, want 127.0.0.1:7001", peers)
+	}
+}
+
+func TestLSDIgnoresOwnAnnounces(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{3}, 20)
+	conn, addr := listenLoopbackUDP(t)
+	l := newLoopbackLSD(t, conn, addr, 7003)
+	l.Watch(infoHash)
+	if err := l.Announce(infoHash); err != nil {
+		t.Fatal(err)
+	}
+
+	// A node with another cookie announcing after ours proves ours was
+	// delivered and dropped rather than still in flight.
+	otherConn, _ := listenLoopbackUDP(t)
+	other := newLoopbackLSD(t, otherConn, addr, 7004)
+	if err := other.Announce(infoHash); err != nil {
+		t.Fatal(err)
+	}
+	peers := waitForLSDPeers(l, infoHash, 1)
+	if len(peers) != 1 || peers[0].Port != 7004 {
+		t.Errorf("got peers %v, want only the other node", peers)
+	}
+}
+
+func TestLSDAnnounceInterval(t *testing.T) {
+	conn, addr := listenLoopbackUDP(t)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	senderConn, _ := listenLoopbackUDP(t)
+	l := newLoopbackLSD(t, senderConn, addr, 7005)
+	first, second := bytes.Repeat([]byte{4}, 20), bytes.Repeat([]byte{5}, 20)
+	for _, infoHashes := range [][][]byte{{first}, {first}, {first, second}} {
+		if err := l.Announce(infoHashes...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The repeated announce of first is dropped, and only second is left in
+	// the last one.
+	buffer := make([]byte, 1500)
+	for _, want := range [][]byte{first, second} {
+		read, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		announce, err := parseLSDAnnounce(buffer[:read])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(announce.InfoHashes) != 1 || !bytes.Equal(announce.InfoHashes[0], want) {
+			t.Errorf("announced %x, want %x", announce.InfoHashes, want)
+		}
+	}
+}
+
+func TestTrackerSessionReannouncesOnLSD(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{0xab}, 20)
+	group, groupAddr := listenLoopbackUDP(t)
+	defer group.Close()
+	conn, addr := listenLoopbackUDP(t)
+	node := newLoopbackLSD(t, conn, groupAddr, 6881)
+	node.Watch(infoHash)
+
+	session := newTrackerSession(&Metainfo{InfoHash: infoHash})
+	session.lsd = []*LSD{node}
+	session.lsdInterval = 20 * time.Millisecond
+	session.started = true
+	go session.run()
+	defer session.Stop()
+
+	buffer := make([]byte, 1500)
+	group.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for i := range 2 {
+		read, _, err := group.ReadFrom(buffer)
+		if err != nil {
+			t.Fatalf("announce %d: %v", i, err)
+		}
+		if _, err := parseLSDAnnounce(buffer[:read]); err != nil {
+			t.Fatal(err)
+		}
+		node.mu.Lock()
+		node.announced[string(infoHash)] = time.Now().Add(-lsdAnnounceInterval)
+		node.mu.Unlock()
+	}
+
+	announce := LSDAnnounce{Port: 7000, InfoHashes: [][]byte{infoHash}}
+	if _, err := group.WriteTo(announce.marshal(groupAddr), net.UDPAddrFromAddrPort(addr)); err != nil {
+		t.Fatal(err)
+	}
+	want := netip.MustParseAddrPort("127.0.0.1:7000")
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case peers := <-session.Peers():
+			if len(peers) == 1 && peers[0].AddrPort() == want {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("session did not deliver the local peer %v", want)
+		}
+	}
+}
@@ -21,6 +21,16 @@ func main() {
 		executeDownloadPiece(args)
 	} else if command == "download" {
 		executeDownload(args)
+	} else if command == "scrape" {
+		executeScrape(args)
+	} else if command == "tracker" {
+		executeTracker(args)
+	} else if command == "dht-put" {
+		executeDHTPut(args)
+	} else if command == "dht-get" {
+		executeDHTGet(args)
+	} else if command == "create" {
+		executeCreate(args)
 	} else if command == "magnet_parse" {
 		executeMagnetParse(args)
 	} else if command == "magnet_handshake" {
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/sha256"
+)
+
+// merkleBlockSize is the size of the leaves of the v2 merkle trees (BEP 52).
+const merkleBlockSize = 16 * 1024
+
+// merkleWidth returns the number of leaves of a tree holding count hashes,
+// which is count rounded up to a power of two.
+func merkleWidth(count int) int {
+	width := 1
+	for width < count {
+		width *= 2
+	}
+	return width
+}
+
+// merkleRoot reduces hashes to the root of a binary tree with width leaves,
+// filling the leaves past the end of hashes with pad.
+func merkleRoot(hashes [][sha256.Size]byte, width int, pad [sha256.Size]byte) [sha256.Size]byte {
+	layer := make([][sha256.Size]byte, width)
+	copy(layer, hashes)
+	for i := len(hashes); i < width; i++ {
+		layer[i] = pad
+	}
+
+	for len(layer) > 1 {
+		next := layer[:len(layer)/2]
+		for i := range next {
+			var pair [2 * sha256.Size]byte
+			copy(pair[:], layer[2*i][:])
+			copy(pair[sha256.Size:], layer[2*i+1][:])
+			next[i] = sha256.Sum256(pair[:])
+		}
+		layer = next
+	}
+	return layer[0]
+}
+
+// merklePadHash is the root of a subtree spanning pieceLength bytes of
+// nothing, used to pad the piece layer up to a power of two.
+func merklePadHash(pieceLength int) [sha256.Size]byte {
+	return merkleRoot(nil, pieceLength/merkleBlockSize, [sha256.Size]byte{})
+}
+
+// blockHashes returns the SHA-256 leaf hashes of data split into 16 KiB
+// blocks; the final block is hashed as is, without padding.
+func blockHashes(data []byte) [][sha256.Size]byte {
+	hashes := make([][sha256.Size]byte, 0, (len(data)+merkleBlockSize-1)/merkleBlockSize)
+	for offset := 0; offset < len(data); offset += merkleBlockSize {
+		hashes = append(hashes, sha256.Sum256(data[offset:min(offset+merkleBlockSize, len(data))]))
+	}
+	return hashes
+}
+
+func splitHashes(layer []byte) [][sha256.Size]byte {
+	hashes := make([][sha256.Size]byte, 0, len(layer)/sha256.Size)
+	for offset := 0; offset+sha256.Size <= len(layer); offset += sha256.Size {
+		hashes = append(hashes, [sha256.Size]byte(layer[offset:offset+sha256.Size]))
+	}
+	return hashes
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Peer wire message ids (BEP 3, BEP 10).
+const (
+	msgChoke         byte = 0
+	msgUnchoke       byte = 1
+	msgInterested    byte = 2
+	msgNotInterested byte = 3
+	msgHave          byte = 4
+	msgBitfield      byte = 5
+	msgRequest       byte = 6
+	msgPiece         byte = 7
+	msgCancel        byte = 8
+	msgPort          byte = 9
+	msgExtended      byte = 20
+)
+
+const (
+	// maxMessageSize bounds the length prefix we accept, large enough for a
+	// 16 KiB block or the bitfield of a torrent with millions of pieces.
+	maxMessageSize = 1 << 20
+	handshakeLen   = 68
+	protocolName   = "BitTorrent protocol"
+)
+
+var errMessageTooLarge = errors.New("peer message too large")
+
+// PeerMessage is a length-prefixed peer wire message. A keep-alive has no id
+// and no payload.
+type PeerMessage struct {
+	keepAlive bool
+	id        byte
+	payload   []byte
+}
+
+func (pm *PeerMessage) serialize() []byte {
+	if pm.keepAlive {
+		return make([]byte, 4)
+	}
+	var payload bytes.Buffer
+	var length [4]byte
+	// 1 byte to account for message id
+	binary.BigEndian.PutUint32(length[:], uint32(len(pm.payload)+1))
+	payload.Write(length[:])
+	payload.WriteByte(pm.id)
+	payload.Write(pm.payload)
+	return payload.Bytes()
+}
+
+// Handshake is the fixed-size message that opens a peer connection.
+type Handshake struct {
+	Reserved [8]byte
+	InfoHash [20]byte
+	PeerID   [20]byte
+}
+
+// SupportsExtensions reports whether the peer set the extension protocol bit
+// (BEP 10).
+func (h Handshake) SupportsExtensions() bool {
+	return h.Reserved[5]&0x10 != 0
+}
+
+// MessageReader reads peer wire messages, one exact length prefix and body
+// at a time.
+type MessageReader struct {
+	r       io.Reader
+	maxSize uint32
+}
+
+func NewMessageReader(r io.Reader) *MessageReader {
+	return &MessageReader{r: r, maxSize: maxMessageSize}
+}
+
+func (m *MessageReader) ReadHandshake() (Handshake, error) {
+	var buffer [handshakeLen]byte
+	if _, err := io.ReadFull(m.r, buffer[:]); err != nil {
+		return Handshake{}, fmt.Errorf("unable to read handshake: %w", err)
+	}
+	if buffer[0] != byte(len(protocolName)) || string(buffer[1:20]) != protocolName {
+		return Handshake{}, errors.New("peer does not speak the bittorrent protocol")
+	}
+	return Handshake{
+		Reserved: [8]byte(buffer[20:28]),
+		InfoHash: [20]byte(buffer[28:48]),
+		PeerID:   [20]byte(buffer[48:68]),
+	}, nil
+}
+
+func (m *MessageReader) ReadMessage() (PeerMessage, error) {
+	var prefix [4]byte
+	if _, err := io.ReadFull(m.r, prefix[:]); err != nil {
+		return PeerMessage{}, fmt.Errorf("unable to read message length: %w", err)
+	}
+	length := binary.BigEndian.Uint32(prefix[:])
+	if length == 0 {
+		return PeerMessage{keepAlive: true}, nil
+	}
+	if length > m.maxSize {
+		return PeerMessage{}, fmt.Errorf("%w: %d bytes", errMessageTooLarge, length)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(m.r, body); err != nil {
+		return PeerMessage{}, fmt.Errorf("unable to read message: %w", err)
+	}
+	return PeerMessage{id: body[0], payload: body[1:]}, nil
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"slices"
+)
+
+type Metainfo struct {
+	Announce     string            `bencode:"announce,omitempty"`
+	AnnounceList [][]string        `bencode:"announce-list,omitempty"`
+	Comment      string            `bencode:"comment,omitempty"`
+	CreatedBy    string            `bencode:"created by,omitempty"`
+	CreationDate int64             `bencode:"creation date,omitempty"`
+	URLList      []string          `bencode:"url-list,omitempty"`
+	RawInfo      RawMessage        `bencode:"info,required"`
+	PieceLayers  map[string][]byte `bencode:"piece layers,omitempty"`
+	Info         Info              `bencode:"-"`
+	// InfoHash is the 20 byte hash used on the wire: the v1 info hash, or the
+	// truncated v2 info hash for torrents without v1 metadata.
+	InfoHash   []byte `bencode:"-"`
+	InfoHashV2 []byte `bencode:"-"`
+}
+
+type Info struct {
+	Length      int        `bencode:"length,omitempty"`
+	Files       []FileInfo `bencode:"files,omitempty"`
+	Name        string     `bencode:"name,required"`
+	PieceLength int        `bencode:"piece length,required"`
+	Pieces      []byte     `bencode:"pieces,omitempty"`
+	MetaVersion int        `bencode:"meta version,omitempty"`
+	FileTree    *FileTree  `bencode:"file tree,omitempty"`
+	Private     int        `bencode:"private,omitempty"`
+}
+
+// FileInfo is an entry of the files list of a multi-file torrent. Path holds
+// the path segments relative to the torrent directory; Attr contains "p" for
+// the padding files hybrid torrents use to align files to pieces (BEP 47).
+type FileInfo struct {
+	Length int      `bencode:"length,required"`
+	Path   []string `bencode:"path,required"`
+	Attr   string   `bencode:"attr,omitempty"`
+}
+
+func (file *FileInfo) IsPadding() bool {
+	return slices.Contains([]byte(file.Attr), 'p')
+}
+
+// FileTree is the v2 "file tree" (BEP 52). Directories map names to subtrees,
+// and a file is a node whose empty key holds its length and pieces root.
+type FileTree struct {
+	File     *FileTreeFile
+	Children map[string]*FileTree
+}
+
+type FileTreeFile struct {
+	Length     int    `bencode:"length,required"`
+	PiecesRoot []byte `bencode:"pieces root,omitempty"`
+}
+
+func (tree *FileTree) UnmarshalBencode(data []byte) error {
+	var entries map[string]RawMessage
+	if err := Unmarshal(data, &entries); err != nil {
+		return err
+	}
+
+	tree.Children = make(map[string]*FileTree)
+	for name, raw := range entries {
+		if name == "" {
+			tree.File = new(FileTreeFile)
+			if err := Unmarshal(raw, tree.File); err != nil {
+				return err
+			}
+			continue
+		}
+		child := new(FileTree)
+		if err := child.UnmarshalBencode(raw); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		tree.Children[name] = child
+	}
+	return nil
+}
+
+func (tree FileTree) MarshalBencode() ([]byte, error) {
+	entries := make(map[string]any, len(tree.Children)+1)
+	if tree.File != nil {
+		entries[""] = tree.File
+	}
+	for name, child := range tree.Children {
+		entries[name] = child
+	}
+	return Marshal(entries)
+}
+
+// V2File is a file of a v2 torrent, flattened out of the file tree.
+type V2File struct {
+	Path       []string
+	Length     int
+	PiecesRoot []byte
+}
+
+// V2Files walks the file tree in key order, which is the order the files are
+// laid out in for the purpose of piece indexes.
+func (info *Info) V2Files() []V2File {
+	var files []V2File
+	var walk func(tree *FileTree, path []string)
+	walk = func(tree *FileTree, path []string) {
+		if tree.File != nil {
+			files = append(files, V2File{
+				Path:       slices.Clone(path),
+				Length:     tree.File.Length,
+				PiecesRoot: tree.File.PiecesRoot,
+			})
+		}
+		names := make([]string, 0, len(tree.Children))
+		for name := range tree.Children {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			walk(tree.Children[name], append(path, name))
+		}
+	}
+	if info.FileTree != nil {
+		walk(info.FileTree, nil)
+	}
+	return files
+}
+
+func (info *Info) HasV1() bool {
+	return info.Pieces != nil
+}
+
+func (info *Info) HasV2() bool {
+	return info.MetaVersion == 2
+}
+
+func (info *Info) IsMultiFile() bool {
+	if !info.HasV1() {
+		files := info.V2Files()
+		return len(files) != 1 || !slices.Equal(files[0].Path, []string{info.Name})
+	}
+	return info.Files != nil
+}
+
+// TotalLength is the size of all the data described by the torrent, not
+// counting padding.
+func (info *Info) TotalLength() int {
+	var total int
+	switch {
+	case !info.HasV1():
+		for _, file := range info.V2Files() {
+			total += file.Length
+		}
+	case !info.IsMultiFile():
+		total = info.Length
+	default:
+		for _, file := range info.Files {
+			if !file.IsPadding() {
+				total += file.Length
+			}
+		}
+	}
+	return total
+}
+
+// PieceHashes splits the concatenated SHA-1 piece hashes into one slice per
+// piece.
+func (info *Info) PieceHashes() [][]byte {
+	count := len(info.Pieces) / sha1.Size
+	pieces := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		pieces = append(pieces, info.Pieces[i*sha1.Size:(i+1)*sha1.Size])
+	}
+	return pieces
+}
+
+func parseMetainfo(r io.Reader) (Metainfo, error) {
+	var metainfo Metainfo
+	if err := NewDecoder(r).DecodeInto(&metainfo); err != nil {
+		return Metainfo{}, fmt.Errorf("unable to decode metainfo: %w", err)
+	}
+
+	info, err := parseInfo(metainfo.RawInfo)
+	if err != nil {
+		return Metainfo{}, err
+	}
+	metainfo.Info = info
+	// Hash the info dictionary exactly as it appears in the file. Re-encoding
+	// the decoded value would sort keys and normalise it, yielding a different
+	// hash than every other client for torrents that are not canonical.
+	if info.HasV2() {
+		infoHashV2 := sha256.Sum256(metainfo.RawInfo)
+		metainfo.InfoHashV2 = infoHashV2[:]
+		metainfo.InfoHash = infoHashV2[:sha1.Size]
+		if err := verifyPieceLayers(&info, metainfo.PieceLayers); err != nil {
+			return Metainfo{}, err
+		}
+	}
+	if info.HasV1() {
+		infoHash := sha1.Sum(metainfo.RawInfo)
+		metainfo.InfoHash = infoHash[:]
+	}
+
+	return metainfo, nil
+}
+
+// parseInfo decodes an info dictionary, either from a metainfo file or as
+// received from peers through the metadata extension.
+func parseInfo(raw []byte) (Info, error) {
+	var info Info
+	if err := Unmarshal(raw, &info); err != nil {
+		return Info{}, fmt.Errorf("unable to decode info dictionary: %w", err)
+	}
+	if info.PieceLength <= 0 {
+		return Info{}, fmt.Errorf("invalid piece length %d", info.PieceLength)
+	}
+	if !info.HasV1() && !info.HasV2() {
+		return Info{}, fmt.Errorf("info dictionary has neither pieces nor a v2 file tree")
+	}
+	if info.HasV1() {
+		if err := validateV1Info(&info); err != nil {
+			return Info{}, err
+		}
+	}
+	if info.HasV2() {
+		if err := validateV2Info(&info); err != nil {
+			return Info{}, err
+		}
+	}
+	return info, nil
+}
+
+func validateV1Info(info *Info) error {
+	if len(info.Pieces)%sha1.Size != 0 {
+		return fmt.Errorf("pieces length %d is not a multiple of %d", len(info.Pieces), sha1.Size)
+	}
+	if info.Files != nil && info.Length != 0 {
+		return fmt.Errorf("info dictionary has both length and files")
+	}
+	var length int
+	for _, file := range info.Files {
+		if file.Length < 0 {
+			return fmt.Errorf("invalid length %d for file %q", file.Length, file.Path)
+		}
+		length += file.Length
+	}
+	if info.Files == nil {
+		length = info.Length
+	}
+	pieceCount := (length + info.PieceLength - 1) / info.PieceLength
+	if pieceCount != len(info.Pieces)/sha1.Size {
+		return fmt.Errorf("info describes %d pieces but has %d piece hashes", pieceCount, len(info.Pieces)/sha1.Size)
+	}
+	return nil
+}
+
+func validateV2Info(info *Info) error {
+	if info.PieceLength < merkleBlockSize || info.PieceLength&(info.PieceLength-1) != 0 {
+		return fmt.Errorf("v2 piece length %d is not a power of two of at least %d", info.PieceLength, merkleBlockSize)
+	}
+	files := info.V2Files()
+	if len(files) == 0 {
+		return fmt.Errorf("v2 file tree is empty")
+	}
+	for _, file := range files {
+		if file.Length < 0 {
+			return fmt.Errorf("invalid length %d for file %q", file.Length, file.Path)
+		}
+		if file.Length > 0 && len(file.PiecesRoot) != sha256.Size {
+			return fmt.Errorf("file %q has an invalid pieces root", file.Path)
+		}
+	}
+	return nil
+}
+
+// verifyPieceLayers checks that every file spanning more than one piece has a
+// piece layer and that the layer hashes up to the file's pieces root.
+func verifyPieceLayers(info *Info, pieceLayers map[string][]byte) error {
+	for _, file := range info.V2Files() {
+		if file.Length <= info.PieceLength {
+			continue
+		}
+		layer, ok := pieceLayers[string(file.PiecesRoot)]
+		if !ok {
+			return fmt.Errorf("missing piece layer for file %q", file.Path)
+		}
+		pieceCount := (file.Length + info.PieceLength - 1) / info.PieceLength
+		if len(layer) != pieceCount*sha256.Size {
+			return fmt.Errorf("piece layer for file %q has %d bytes, want %d", file.Path, len(layer), pieceCount*sha256.Size)
+		}
+		root := merkleRoot(splitHashes(layer), merkleWidth(pieceCount), merklePadHash(info.PieceLength))
+		if string(root[:]) != string(file.PiecesRoot) {
+			return fmt.Errorf("piece layer for file %q does not match its pieces root", file.Path)
+		}
+	}
+	return nil
+}
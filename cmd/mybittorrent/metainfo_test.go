@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The fixtures are not canonical bencode: their info dictionaries have
+// unsorted keys or fields Info does not know about, so re-encoding the
+// parsed info would change the hash.
+func TestParseMetainfoHashesRawInfo(t *testing.T) {
+	tests := []struct {
+		file     string
+		infoHash string
+	}{
+		{"unsorted_keys.torrent", "f7bada3bf91727c4b0e5ebeca437587072fa0102"},
+		{"extra_fields.torrent", "0846f0e39566d3fefe259ebbf7d425c313136c77"},
+		{"multi_file_unsorted.torrent", "c1d65dd99cb4b52e8ab7d1f012334f5ac3f0c462"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			f, err := os.Open(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			metainfo, err := parseMetainfo(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := hex.EncodeToString(metainfo.InfoHash); got != tt.infoHash {
+				t.Errorf("info hash %s, want %s", got, tt.infoHash)
+			}
+
+			reencoded, err := Marshal(metainfo.Info)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(reencoded, metainfo.RawInfo) {
+				t.Fatal("fixture is canonical, it does not tell raw and re-encoded info apart")
+			}
+			if hash := sha1.Sum(reencoded); bytes.Equal(hash[:], metainfo.InfoHash) {
+				t.Error("info hash matches the re-encoded info dictionary")
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+)
+
+// Peer is a peer address as learned from a tracker or another peer source.
+// ID is only known when the source reports it.
+type Peer struct {
+	Addr netip.Addr
+	Port uint16
+	ID   []byte
+}
+
+func (p Peer) AddrPort() netip.AddrPort {
+	return netip.AddrPortFrom(p.Addr, p.Port)
+}
+
+func (p Peer) String() string {
+	return p.AddrPort().String()
+}
+
+// PeerPool is the set of peers known for a torrent. Trackers, the DHT and
+// peer exchange add to it, and download commands take the peers they connect
+// to from it, each peer at most once.
+type PeerPool struct {
+	mu        sync.Mutex
+	known     map[netip.AddrPort]bool
+	queue     []Peer
+	connected map[netip.AddrPort]Peer
+}
+
+func newPeerPool(peers []Peer) *PeerPool {
+	pool := &PeerPool{
+		known:     make(map[netip.AddrPort]bool),
+		connected: make(map[netip.AddrPort]Peer),
+	}
+	pool.Add(peers...)
+	return pool
+}
+
+// Add queues the peers that are not known yet and returns how many were new.
+func (p *PeerPool) Add(peers ...Peer) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var added int
+	for _, peer := range peers {
+		peer.Addr = peer.Addr.Unmap()
+		addrPort := peer.AddrPort()
+		if !addrPort.IsValid() || peer.Port == 0 || peer.Addr.IsUnspecified() || p.known[addrPort] {
+			continue
+		}
+		p.known[addrPort] = true
+		p.queue = append(p.queue, peer)
+		added++
+	}
+	return added
+}
+
+// Next returns the next peer that has not been handed out yet.
+func (p *PeerPool) Next() (Peer, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.queue) == 0 {
+		return Peer{}, false
+	}
+	peer := p.queue[0]
+	p.queue = p.queue[1:]
+	return peer, true
+}
+
+// Queued is the number of peers not handed out yet.
+func (p *PeerPool) Queued() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.queue)
+}
+
+var errNoPeers = errors.New("no peers available")
+
+// Connect dials queued peers in order until one accepts the connection.
+func (p *PeerPool) Connect() (*TCPClient, Peer, error) {
+	var errs []error
+	for {
+		peer, ok := p.Next()
+		if !ok {
+			if len(errs) == 0 {
+				return nil, Peer{}, errNoPeers
+			}
+			return nil, Peer{}, fmt.Errorf("unable to connect to any peer: %w", errors.Join(errs...))
+		}
+		client, err := NewTCPClient(peer.String())
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		p.mu.Lock()
+		p.connected[peer.AddrPort()] = peer
+		p.mu.Unlock()
+		return client, peer, nil
+	}
+}
+
+func (p *PeerPool) Disconnected(peer Peer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.connected, peer.AddrPort())
+}
+
+// Connected returns the peers we currently hold a connection to.
+func (p *PeerPool) Connected() []Peer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	peers := make([]Peer, 0, len(p.connected))
+	for _, peer := range p.connected {
+		peers = append(peers, peer)
+	}
+	return peers
+}
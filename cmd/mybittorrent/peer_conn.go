@@ -0,0 +1,510 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+)
+
+const (
+	blockSize = 16 * 1024
+	// The number of requests a connection keeps in flight is sized to cover
+	// requestQueueTime of downloading at the measured rate, within
+	// minRequests and maxRequests.
+	minRequests      = 2
+	maxRequests      = 250
+	requestQueueTime = 3 * time.Second
+	// rateInterval is how often the download rate is sampled.
+	rateInterval = time.Second
+)
+
+type BlockRequest struct {
+	index  uint32
+	begin  uint32
+	length uint32
+}
+
+func (r BlockRequest) serialize() []byte {
+	payload := make([]byte, 0, 12)
+	payload = binary.BigEndian.AppendUint32(payload, r.index)
+	payload = binary.BigEndian.AppendUint32(payload, r.begin)
+	return binary.BigEndian.AppendUint32(payload, r.length)
+}
+
+// PeerConn is a connection to a peer after the handshake. It tracks the
+// choke and interest state of both sides and queues block requests, sending
+// them only while the peer has us unchoked.
+type PeerConn struct {
+	client *TCPClient
+	peer   Peer
+	pool   *PeerPool
+	pex    *PexState
+	// picker, when set, is told about the pieces the peer has once the piece
+	// count is known.
+	picker PiecePicker
+
+	amChoking      bool
+	amInterested   bool
+	peerChoking    bool
+	peerInterested bool
+	dhtPort        uint16
+
+	// pieceCount is zero until the metadata is known. Before that the
+	// bitfield and have messages are kept as received.
+	pieceCount  int
+	bitfield    Bitfield
+	rawBitfield []byte
+	haves       []int
+	sawBitfield bool
+
+	queue   []BlockRequest
+	pending []BlockRequest
+
+	// maxRequests caps window, the number of requests kept in flight, which
+	// grows by one per block until the first rate sample is taken.
+	maxRequests int
+	window      int
+	rate        float64
+	rateBytes   int
+	rateSince   time.Time
+
+	// incoming is set once messages are read in the background, and stop
+	// ends the reader.
+	incoming chan peerRead
+	stop     chan struct{}
+}
+
+// peerRead is a message, or the error that ended the connection, read in the
+// background.
+type peerRead struct {
+	msg PeerMessage
+	err error
+}
+
+func newPeerConn(client *TCPClient) *PeerConn {
+	return &PeerConn{
+		client:      client,
+		amChoking:   true,
+		peerChoking: true,
+		maxRequests: maxRequests,
+		window:      minRequests,
+		stop:        make(chan struct{}),
+	}
+}
+
+// Close closes the connection and stops the background reader.
+func (c *PeerConn) Close() error {
+	select {
+	case <-c.stop:
+	default:
+		close(c.stop)
+	}
+	return c.client.Close()
+}
+
+// Incoming starts reading messages in the background, so that callers can
+// wait for them together with other events, and returns the channel they
+// arrive on. The error that ends the connection is delivered last. Messages
+// must be passed to Receive, and not read any other way from then on.
+func (c *PeerConn) Incoming() <-chan peerRead {
+	if c.incoming != nil {
+		return c.incoming
+	}
+	c.incoming = make(chan peerRead)
+	go func() {
+		for {
+			msg, err := c.client.ReadMessage()
+			select {
+			case c.incoming <- peerRead{msg, err}:
+			case <-c.stop:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return c.incoming
+}
+
+// Window is the number of requests the connection wants in flight. Callers
+// keep at least that many blocks queued so the pipeline never runs dry.
+func (c *PeerConn) Window() int {
+	return c.window
+}
+
+// Outstanding is the number of blocks queued or requested and not received.
+func (c *PeerConn) Outstanding() int {
+	return len(c.queue) + len(c.pending)
+}
+
+// Rate is the measured download rate in bytes per second.
+func (c *PeerConn) Rate() float64 {
+	return c.rate
+}
+
+// updateRate accounts for a received block and resizes the window from the
+// download rate, smoothed over the last few samples.
+func (c *PeerConn) updateRate(received int) {
+	now := time.Now()
+	if c.rateSince.IsZero() {
+		c.rateSince = now
+	}
+	c.rateBytes += received
+
+	elapsed := now.Sub(c.rateSince)
+	if elapsed < rateInterval {
+		if c.rate == 0 {
+			c.window = min(c.window+1, c.maxRequests)
+		}
+		return
+	}
+	sample := float64(c.rateBytes) / elapsed.Seconds()
+	if c.rate == 0 {
+		c.rate = sample
+	} else {
+		c.rate = 0.7*c.rate + 0.3*sample
+	}
+	c.rateBytes = 0
+	c.rateSince = now
+
+	window := int(c.rate * requestQueueTime.Seconds() / blockSize)
+	c.window = max(minRequests, min(window, c.maxRequests))
+}
+
+// SetInterested tells the peer whether we want to download from it.
+func (c *PeerConn) SetInterested(interested bool) error {
+	if c.amInterested == interested {
+		return nil
+	}
+	id := msgNotInterested
+	if interested {
+		id = msgInterested
+	}
+	if err := c.client.WriteMessage(PeerMessage{id: id}); err != nil {
+		return err
+	}
+	c.amInterested = interested
+	return nil
+}
+
+// SetPieceCount validates the availability the peer sent before the size of
+// the torrent was known.
+func (c *PeerConn) SetPieceCount(pieceCount int) error {
+	if c.pieceCount != 0 {
+		return nil
+	}
+	bitfield := newBitfield(pieceCount)
+	if c.rawBitfield != nil {
+		var err error
+		if bitfield, err = parseBitfield(c.rawBitfield, pieceCount); err != nil {
+			return err
+		}
+	}
+	for _, index := range c.haves {
+		if index >= pieceCount {
+			return fmt.Errorf("invalid have message for piece %d of %d", index, pieceCount)
+		}
+		bitfield.Set(index)
+	}
+	c.pieceCount = pieceCount
+	c.bitfield = bitfield
+	c.rawBitfield = nil
+	c.haves = nil
+	if c.picker != nil {
+		c.picker.AddBitfield(bitfield)
+	}
+	return nil
+}
+
+// HasPiece reports whether the peer advertised the piece.
+func (c *PeerConn) HasPiece(index int) bool {
+	return c.bitfield.Has(index)
+}
+
+// SendBitfield tells the peer which pieces we have. It must be the first
+// message after the handshake and is left out when we have none.
+func (c *PeerConn) SendBitfield(have Bitfield) error {
+	if have.Count() == 0 {
+		return nil
+	}
+	return c.client.WriteMessage(PeerMessage{id: msgBitfield, payload: have})
+}
+
+func (c *PeerConn) SendHave(index int) error {
+	return c.client.WriteMessage(PeerMessage{
+		id:      msgHave,
+		payload: binary.BigEndian.AppendUint32(nil, uint32(index)),
+	})
+}
+
+// WaitForPiece handles incoming messages until the peer has the piece.
+func (c *PeerConn) WaitForPiece(index int) error {
+	for !c.HasPiece(index) {
+		if err := c.readMessage(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WaitForExtended handles incoming messages until an extended message with
+// the given extended id arrives, and returns its payload without the id.
+func (c *PeerConn) WaitForExtended(extensionID byte) ([]byte, error) {
+	for {
+		msg, err := c.client.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if !msg.keepAlive && msg.id == msgExtended && len(msg.payload) > 0 && msg.payload[0] == extensionID {
+			return msg.payload[1:], nil
+		}
+		if _, _, err := c.handle(msg); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (c *PeerConn) readMessage() error {
+	msg, err := c.client.ReadMessage()
+	if err != nil {
+		return err
+	}
+	_, _, err = c.handle(msg)
+	return err
+}
+
+// Choked reports whether the peer is choking us.
+func (c *PeerConn) Choked() bool {
+	return c.peerChoking
+}
+
+// Request queues blocks to be requested once the peer unchokes us.
+func (c *PeerConn) Request(requests ...BlockRequest) error {
+	c.queue = append(c.queue, requests...)
+	return c.sendRequests()
+}
+
+// DropRequests forgets the blocks queued or requested, for pieces that were
+// given up. Blocks that still arrive for them are ignored.
+func (c *PeerConn) DropRequests() {
+	c.queue = nil
+	c.pending = nil
+}
+
+func (c *PeerConn) sendRequests() error {
+	for !c.peerChoking && len(c.pending) < c.window && len(c.queue) > 0 {
+		request := c.queue[0]
+		err := c.client.WriteMessage(PeerMessage{id: msgRequest, payload: request.serialize()})
+		if err != nil {
+			return err
+		}
+		c.queue = c.queue[1:]
+		c.pending = append(c.pending, request)
+	}
+	return nil
+}
+
+// ReadBlock handles incoming messages until a block we asked for arrives.
+func (c *PeerConn) ReadBlock() (BlockRequest, []byte, error) {
+	for {
+		if len(c.queue) == 0 && len(c.pending) == 0 {
+			return BlockRequest{}, nil, errors.New("no blocks requested")
+		}
+		msg, err := c.client.ReadMessage()
+		if err != nil {
+			return BlockRequest{}, nil, err
+		}
+		request, block, err := c.Receive(msg)
+		if err != nil {
+			return BlockRequest{}, nil, err
+		}
+		if block != nil {
+			return request, block, nil
+		}
+	}
+}
+
+// Receive handles a message read from the peer and returns the block it
+// carries, if it answers one of our requests.
+func (c *PeerConn) Receive(msg PeerMessage) (BlockRequest, []byte, error) {
+	request, block, err := c.handle(msg)
+	if err != nil {
+		return BlockRequest{}, nil, err
+	}
+	if err := c.SendPex(); err != nil {
+		return BlockRequest{}, nil, err
+	}
+	return request, block, nil
+}
+
+// handle updates the connection state for msg and returns the block it
+// carries, if it answers one of our requests.
+func (c *PeerConn) handle(msg PeerMessage) (BlockRequest, []byte, error) {
+	if msg.keepAlive {
+		return BlockRequest{}, nil, nil
+	}
+	var err error
+	switch msg.id {
+	case msgChoke:
+		err = c.handleChoke()
+	case msgUnchoke:
+		err = c.handleUnchoke()
+	case msgInterested:
+		c.peerInterested = true
+	case msgNotInterested:
+		c.peerInterested = false
+	case msgHave:
+		err = c.handleHave(msg.payload)
+	case msgBitfield:
+		err = c.handleBitfield(msg.payload)
+	case msgRequest, msgCancel:
+		err = c.handleRequest(msg.payload)
+	case msgPiece:
+		return c.handlePiece(msg.payload)
+	case msgPort:
+		err = c.handlePort(msg.payload)
+	case msgExtended:
+		c.handleExtended(msg.payload)
+	}
+	return BlockRequest{}, nil, err
+}
+
+// handleChoke puts our outstanding requests back in the queue, as a peer
+// drops the requests of the peers it chokes.
+func (c *PeerConn) handleChoke() error {
+	c.peerChoking = true
+	c.queue = append(c.pending, c.queue...)
+	c.pending = nil
+	return nil
+}
+
+func (c *PeerConn) handleUnchoke() error {
+	c.peerChoking = false
+	return c.sendRequests()
+}
+
+func (c *PeerConn) handleHave(payload []byte) error {
+	if len(payload) != 4 {
+		return fmt.Errorf("invalid have message of %d bytes", len(payload))
+	}
+	index := int(binary.BigEndian.Uint32(payload))
+	if c.pieceCount == 0 {
+		c.haves = append(c.haves, index)
+		return nil
+	}
+	if index >= c.pieceCount {
+		return fmt.Errorf("invalid have message for piece %d of %d", index, c.pieceCount)
+	}
+	if !c.bitfield.Has(index) {
+		c.bitfield.Set(index)
+		if c.picker != nil {
+			c.picker.AddHave(index)
+		}
+	}
+	return nil
+}
+
+func (c *PeerConn) handleBitfield(payload []byte) error {
+	if c.sawBitfield || c.bitfield.Count() > 0 || len(c.haves) > 0 {
+		return errors.New("unexpected bitfield message")
+	}
+	c.sawBitfield = true
+	if c.pieceCount == 0 {
+		c.rawBitfield = payload
+		return nil
+	}
+	bitfield, err := parseBitfield(payload, c.pieceCount)
+	if err != nil {
+		return err
+	}
+	c.bitfield = bitfield
+	if c.picker != nil {
+		c.picker.AddBitfield(bitfield)
+	}
+	return nil
+}
+
+// handleRequest validates requests and cancels from the peer. We never
+// unchoke peers, so there is nothing to serve or cancel.
+func (c *PeerConn) handleRequest(payload []byte) error {
+	if len(payload) != 12 {
+		return fmt.Errorf("invalid request message of %d bytes", len(payload))
+	}
+	return nil
+}
+
+func (c *PeerConn) handlePiece(payload []byte) (BlockRequest, []byte, error) {
+	if len(payload) < 8 {
+		return BlockRequest{}, nil, fmt.Errorf("invalid piece message of %d bytes", len(payload))
+	}
+	request := BlockRequest{
+		index:  binary.BigEndian.Uint32(payload[0:4]),
+		begin:  binary.BigEndian.Uint32(payload[4:8]),
+		length: uint32(len(payload) - 8),
+	}
+	// a block may still arrive after a choke moved its request back to the
+	// queue
+	if i := slices.Index(c.pending, request); i >= 0 {
+		c.pending = slices.Delete(c.pending, i, i+1)
+	} else if i := slices.Index(c.queue, request); i >= 0 {
+		c.queue = slices.Delete(c.queue, i, i+1)
+	} else {
+		return BlockRequest{}, nil, nil
+	}
+	c.updateRate(int(request.length))
+	if err := c.sendRequests(); err != nil {
+		return BlockRequest{}, nil, err
+	}
+	return request, payload[8:], nil
+}
+
+func (c *PeerConn) handlePort(payload []byte) error {
+	if len(payload) != 2 {
+		return fmt.Errorf("invalid port message of %d bytes", len(payload))
+	}
+	c.dhtPort = binary.BigEndian.Uint16(payload)
+	return nil
+}
+
+// handleExtended sets up peer exchange once the peer's extension handshake
+// arrives and feeds its ut_pex messages to the peer pool.
+func (c *PeerConn) handleExtended(payload []byte) {
+	if len(payload) == 0 {
+		return
+	}
+	switch {
+	case payload[0] == 0 && c.pool != nil:
+		handshake, err := parseExtensionHandshake(payload[1:])
+		if err != nil {
+			log.Println("ignoring extension handshake", err)
+			return
+		}
+		c.pex = newPexState(c.peer, handshake, c.pool)
+	case payload[0] == utPexID && c.pex != nil:
+		if _, err := c.pex.Handle(payload[1:]); err != nil {
+			log.Println("ignoring peer exchange message", err)
+		}
+	}
+}
+
+// SendPex tells the peer about the changes to the peers we are connected
+// to, at most once per pexInterval. It is called for every message received
+// and should also be called periodically, so quiet peers are told as well.
+func (c *PeerConn) SendPex() error {
+	if c.pex == nil {
+		return nil
+	}
+	msg, ok, err := c.pex.Update(time.Now())
+	if err != nil {
+		log.Println("unable to build peer exchange message", err)
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+	return c.client.WriteMessage(msg)
+}
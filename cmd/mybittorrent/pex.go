@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+const (
+	// utPexID is the extended message id we ask peers to use when sending us
+	// ut_pex messages.
+	utPexID = 43
+	// pexInterval is the minimum time between two PEX messages on a
+	// connection, and pexMaxPeers the most peers one message may add or drop
+	// (BEP 11).
+	pexInterval = time.Minute
+	pexMaxPeers = 50
+)
+
+// Flags describing an added peer in added.f and added6.f.
+const (
+	pexFlagEncryption  = 0x01
+	pexFlagSeed        = 0x02
+	pexFlagUTP         = 0x04
+	pexFlagHolepunch   = 0x08
+	pexFlagConnectable = 0x10
+)
+
+// PexMessage is the payload of a ut_pex message (BEP 11): compact IPv4 and
+// IPv6 peers that joined or left the sender's peer set since its last
+// message, with one flags byte per added peer.
+type PexMessage struct {
+	Added    []byte `bencode:"added"`
+	AddedF   []byte `bencode:"added.f"`
+	Added6   []byte `bencode:"added6"`
+	Added6F  []byte `bencode:"added6.f"`
+	Dropped  []byte `bencode:"dropped"`
+	Dropped6 []byte `bencode:"dropped6"`
+}
+
+func newPexMessage(added, dropped []Peer) PexMessage {
+	var msg PexMessage
+	for _, peer := range added {
+		if peer.Addr.Is4() {
+			msg.Added = appendCompactPeer(msg.Added, peer)
+			msg.AddedF = append(msg.AddedF, pexFlagConnectable)
+		} else {
+			msg.Added6 = appendCompactPeer(msg.Added6, peer)
+			msg.Added6F = append(msg.Added6F, pexFlagConnectable)
+		}
+	}
+	for _, peer := range dropped {
+		if peer.Addr.Is4() {
+			msg.Dropped = appendCompactPeer(msg.Dropped, peer)
+		} else {
+			msg.Dropped6 = appendCompactPeer(msg.Dropped6, peer)
+		}
+	}
+	return msg
+}
+
+func parsePexMessage(payload []byte) (added, dropped []Peer, err error) {
+	var msg PexMessage
+	if err := Unmarshal(payload, &msg); err != nil {
+		return nil, nil, fmt.Errorf("invalid pex message: %w", err)
+	}
+	added = append(parseCompactPeers(msg.Added, 4), parseCompactPeers(msg.Added6, 16)...)
+	dropped = append(parseCompactPeers(msg.Dropped, 4), parseCompactPeers(msg.Dropped6, 16)...)
+	return added, dropped, nil
+}
+
+// PexState is the peer exchange state of one connection: the id the remote
+// peer wants ut_pex messages under and the peers we last told it about, so
+// that each message only carries the changes since the previous one.
+type PexState struct {
+	remote      netip.AddrPort
+	extensionID int
+	pool        *PeerPool
+	sent        map[netip.AddrPort]Peer
+	lastSent    time.Time
+}
+
+// newPexState returns nil if the peer did not advertise ut_pex in its
+// extension handshake.
+func newPexState(remote Peer, handshake ExtensionHandshake, pool *PeerPool) *PexState {
+	extensionID, ok := handshake.M["ut_pex"]
+	if !ok || extensionID <= 0 || extensionID > 255 {
+		return nil
+	}
+	return &PexState{
+		remote:      remote.AddrPort(),
+		extensionID: extensionID,
+		pool:        pool,
+		sent:        make(map[netip.AddrPort]Peer),
+	}
+}
+
+// Handle adds the peers a ut_pex message announces to the pool and returns
+// how many of them were new. Messages adding more peers than the spec allows
+// are truncated rather than trusted. Dropped peers are ignored on purpose:
+// the sender only lost its own connection to them, and they may well accept
+// ours.
+func (s *PexState) Handle(payload []byte) (int, error) {
+	added, _, err := parsePexMessage(payload)
+	if err != nil {
+		return 0, err
+	}
+	return s.pool.Add(added[:min(len(added), pexMaxPeers)]...), nil
+}
+
+// Update returns the ut_pex message to send to the peer, if a minute has
+// passed since the last one and the set of peers we are connected to has
+// changed. Changes beyond pexMaxPeers wait for a later message.
+func (s *PexState) Update(now time.Time) (PeerMessage, bool, error) {
+	if now.Sub(s.lastSent) < pexInterval {
+		return PeerMessage{}, false, nil
+	}
+
+	current := make(map[netip.AddrPort]Peer)
+	for _, peer := range s.pool.Connected() {
+		if addrPort := peer.AddrPort(); addrPort != s.remote {
+			current[addrPort] = peer
+		}
+	}
+	var added, dropped []Peer
+	for addrPort, peer := range current {
+		if _, ok := s.sent[addrPort]; !ok && len(added) < pexMaxPeers {
+			added = append(added, peer)
+		}
+	}
+	for addrPort, peer := range s.sent {
+		if _, ok := current[addrPort]; !ok && len(dropped) < pexMaxPeers {
+			dropped = append(dropped, peer)
+		}
+	}
+	if len(added) == 0 && len(dropped) == 0 {
+		return PeerMessage{}, false, nil
+	}
+
+	msg, err := newExtendedMessage(byte(s.extensionID), newPexMessage(added, dropped))
+	if err != nil {
+		return PeerMessage{}, false, err
+	}
+	for _, peer := range added {
+		s.sent[peer.AddrPort()] = peer
+	}
+	for _, peer := range dropped {
+		delete(s.sent, peer.AddrPort())
+	}
+	s.lastSent = now
+	return msg, true, nil
+}
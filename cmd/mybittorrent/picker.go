@@ -0,0 +1,144 @@
+package main
+
+import (
+	"math/rand/v2"
+	"sync"
+)
+
+// randomFirstPieces is how many pieces are picked at random before switching
+// to rarest first, so a new download quickly has whole pieces to share.
+const randomFirstPieces = 4
+
+type PiecePriority int
+
+const (
+	PrioritySkip PiecePriority = iota
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+)
+
+// PiecePicker decides which piece to download next. It is told which pieces
+// the connected peers have, and it must be safe for concurrent use.
+type PiecePicker interface {
+	// AddBitfield and RemoveBitfield count the pieces of a peer that
+	// connected or went away.
+	AddBitfield(have Bitfield)
+	RemoveBitfield(have Bitfield)
+	// AddHave counts a piece a peer announced after its bitfield.
+	AddHave(index int)
+
+	SetPriority(index int, priority PiecePriority)
+	Priority(index int) PiecePriority
+
+	// Pick chooses one of the pieces candidate accepts, given how many
+	// pieces are already complete. Skipped pieces are never picked.
+	Pick(completed int, candidate func(int) bool) (int, bool)
+}
+
+// RarestFirstPicker picks the wanted piece with the highest priority that the
+// fewest peers have, breaking ties at random. The first randomFirst pieces
+// are picked at random among the highest priority ones instead.
+type RarestFirstPicker struct {
+	mu           sync.Mutex
+	availability []int
+	priorities   []PiecePriority
+	randomFirst  int
+	rand         *rand.Rand
+}
+
+func newRarestFirstPicker(pieceCount int) *RarestFirstPicker {
+	priorities := make([]PiecePriority, pieceCount)
+	for i := range priorities {
+		priorities[i] = PriorityNormal
+	}
+	return &RarestFirstPicker{
+		availability: make([]int, pieceCount),
+		priorities:   priorities,
+		randomFirst:  randomFirstPieces,
+		rand:         rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64())),
+	}
+}
+
+func (p *RarestFirstPicker) AddBitfield(have Bitfield) {
+	p.updateAvailability(have, 1)
+}
+
+func (p *RarestFirstPicker) RemoveBitfield(have Bitfield) {
+	p.updateAvailability(have, -1)
+}
+
+func (p *RarestFirstPicker) updateAvailability(have Bitfield, delta int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for index := range p.availability {
+		if have.Has(index) {
+			p.availability[index] += delta
+		}
+	}
+}
+
+func (p *RarestFirstPicker) AddHave(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if index >= 0 && index < len(p.availability) {
+		p.availability[index]++
+	}
+}
+
+func (p *RarestFirstPicker) SetPriority(index int, priority PiecePriority) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if index >= 0 && index < len(p.priorities) {
+		p.priorities[index] = priority
+	}
+}
+
+func (p *RarestFirstPicker) Priority(index int) PiecePriority {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if index < 0 || index >= len(p.priorities) {
+		return PrioritySkip
+	}
+	return p.priorities[index]
+}
+
+func (p *RarestFirstPicker) Pick(completed int, candidate func(int) bool) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	randomFirst := completed < p.randomFirst
+	best, ties := -1, 0
+	for index, priority := range p.priorities {
+		if priority == PrioritySkip || !candidate(index) {
+			continue
+		}
+		order := 1
+		if best >= 0 {
+			order = p.compare(index, best, randomFirst)
+		}
+		switch {
+		case order > 0:
+			best, ties = index, 1
+		case order == 0:
+			// reservoir sampling keeps each tied piece equally likely
+			ties++
+			if p.rand.IntN(ties) == 0 {
+				best = index
+			}
+		}
+	}
+	return best, best >= 0
+}
+
+// compare returns a positive number when piece a should be picked before b,
+// a negative one when b should, and zero when they tie.
+func (p *RarestFirstPicker) compare(a, b int, randomFirst bool) int {
+	if p.priorities[a] != p.priorities[b] {
+		return int(p.priorities[a] - p.priorities[b])
+	}
+	if randomFirst {
+		return 0
+	}
+	return p.availability[b] - p.availability[a]
+}
@@ -0,0 +1,106 @@
+package main
+
+import "testing"
+
+func testBitfield(pieceCount int, pieces ...int) Bitfield {
+	bitfield := newBitfield(pieceCount)
+	for _, index := range pieces {
+		bitfield.Set(index)
+	}
+	return bitfield
+}
+
+func anyPiece(int) bool { return true }
+
+// pickAll picks many times and returns the pieces that came up.
+func pickAll(p *RarestFirstPicker, completed int, candidate func(int) bool) map[int]bool {
+	picked := make(map[int]bool)
+	for range 200 {
+		if index, ok := p.Pick(completed, candidate); ok {
+			picked[index] = true
+		}
+	}
+	return picked
+}
+
+func TestRarestFirstPicker(t *testing.T) {
+	p := newRarestFirstPicker(6)
+	p.AddBitfield(testBitfield(6, 0, 1, 2, 3, 4, 5))
+	p.AddBitfield(testBitfield(6, 0, 1, 2, 3, 4))
+	p.AddBitfield(testBitfield(6, 0, 1, 3))
+	// piece availability is now 3 3 2 3 2 1
+
+	if index, _ := p.Pick(randomFirstPieces, anyPiece); index != 5 {
+		t.Errorf("picked %d, want the rarest piece 5", index)
+	}
+	if index, _ := p.Pick(randomFirstPieces, func(index int) bool { return index != 5 }); index != 2 && index != 4 {
+		t.Errorf("picked %d, want 2 or 4", index)
+	}
+	picked := pickAll(p, randomFirstPieces, func(index int) bool { return index == 2 || index == 4 })
+	if len(picked) != 2 {
+		t.Errorf("picked %v, want ties broken at random between 2 and 4", picked)
+	}
+
+	p.AddHave(5)
+	p.AddHave(5)
+	p.AddHave(4)
+	// 3 3 2 3 3 3
+	if index, _ := p.Pick(randomFirstPieces, anyPiece); index != 2 {
+		t.Errorf("picked %d after have messages, want 2", index)
+	}
+	p.RemoveBitfield(testBitfield(6, 0, 1, 2, 3, 4, 5))
+	p.RemoveBitfield(testBitfield(6, 0, 1, 2, 3, 4))
+	// 1 1 0 1 1 3
+	if index, _ := p.Pick(randomFirstPieces, anyPiece); index != 2 {
+		t.Errorf("picked %d after peers left, want 2", index)
+	}
+}
+
+func TestRarestFirstPickerRandomFirst(t *testing.T) {
+	p := newRarestFirstPicker(4)
+	p.AddBitfield(testBitfield(4, 0, 1, 2, 3))
+	p.AddBitfield(testBitfield(4, 1, 2, 3))
+	p.AddBitfield(testBitfield(4, 2, 3))
+
+	if picked := pickAll(p, 0, anyPiece); len(picked) != 4 {
+		t.Errorf("picked %v before the first pieces completed, want any piece", picked)
+	}
+	if picked := pickAll(p, randomFirstPieces, anyPiece); len(picked) != 1 || !picked[0] {
+		t.Errorf("picked %v once pieces completed, want the rarest piece 0", picked)
+	}
+}
+
+func TestRarestFirstPickerPriorities(t *testing.T) {
+	p := newRarestFirstPicker(4)
+	p.AddBitfield(testBitfield(4, 0, 1, 2, 3))
+	p.AddBitfield(testBitfield(4, 1, 2, 3))
+	p.AddBitfield(testBitfield(4, 2, 3))
+	// 1 2 3 3
+
+	p.SetPriority(0, PrioritySkip)
+	if index, _ := p.Pick(randomFirstPieces, anyPiece); index != 1 {
+		t.Errorf("picked %d, want 1 with piece 0 skipped", index)
+	}
+	p.SetPriority(3, PriorityHigh)
+	if index, _ := p.Pick(randomFirstPieces, anyPiece); index != 3 {
+		t.Errorf("picked %d, want the high priority piece 3", index)
+	}
+	p.SetPriority(1, PriorityLow)
+	p.SetPriority(3, PriorityNormal)
+	if index, _ := p.Pick(randomFirstPieces, func(index int) bool { return index != 2 }); index != 3 {
+		t.Errorf("picked %d, want normal priority piece 3 over the rarer low priority one", index)
+	}
+	if picked := pickAll(p, 0, anyPiece); len(picked) != 2 || picked[0] || picked[1] {
+		t.Errorf("picked %v at random, want only the highest priority pieces 2 and 3", picked)
+	}
+
+	for index := range 4 {
+		p.SetPriority(index, PrioritySkip)
+	}
+	if index, ok := p.Pick(0, anyPiece); ok {
+		t.Errorf("picked skipped piece %d", index)
+	}
+	if p.Priority(4) != PrioritySkip {
+		t.Error("a piece out of range is not skipped")
+	}
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSocksProxy is a SOCKS5 proxy supporting CONNECT and UDP ASSOCIATE.
+// It resolves host names itself and records every destination as it was
+// requested.
+type fakeSocksProxy struct {
+	listener net.Listener
+	username string
+	password string
+
+	mu        sync.Mutex
+	requested []string
+}
+
+func newFakeSocksProxy(t *testing.T, username, password string) *fakeSocksProxy {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &fakeSocksProxy{listener: listener, username: username, password: password}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go proxy.handle(conn)
+		}
+	}()
+	return proxy
+}
+
+func (p *fakeSocksProxy) url() string {
+	u := &url.URL{Scheme: "socks5", Host: p.listener.Addr().String()}
+	if p.username != "" {
+		u.User = url.UserPassword(p.username, p.password)
+	}
+	return u.String()
+}
+
+func (p *fakeSocksProxy) record(destination string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.requested = append(p.requested, destination)
+}
+
+func (p *fakeSocksProxy) destinations() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.requested)
+}
+
+// readSocksDestination reads a SOCKS5 address, keeping host names unresolved.
+func readSocksDestination(r io.Reader) (string, error) {
+	kind := make([]byte, 1)
+	if _, err := io.ReadFull(r, kind); err != nil {
+		return "", err
+	}
+	var host []byte
+	switch kind[0] {
+	case socksAddrIPv4:
+		host = make([]byte, net.IPv4len)
+	case socksAddrIPv6:
+		host = make([]byte, net.IPv6len)
+	case socksAddrDomain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(r, size); err != nil {
+			return "", err
+		}
+		host = make([]byte, size[0])
+	default:
+		return "", errors.New("unknown address type")
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, host); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	hostname := string(host)
+	if kind[0] != socksAddrDomain {
+		addr, _ := netip.AddrFromSlice(host)
+		hostname = addr.String()
+	}
+	return net.JoinHostPort(hostname, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func (p *fakeSocksProxy) handle(conn net.Conn) {
+	defer conn.Close()
+
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		return
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	if p.username == "" {
+		conn.Write([]byte{socksVersion, socksAuthNone})
+	} else {
+		if !slices.Contains(methods, socksAuthPassword) {
+			conn.Write([]byte{socksVersion, socksAuthNoAcceptable})
+			return
+		}
+		conn.Write([]byte{socksVersion, socksAuthPassword})
+		reader := bufio.NewReader(conn)
+		version, _ := reader.ReadByte()
+		username := make([]byte, 0)
+		if size, err := reader.ReadByte(); err == nil {
+			username = make([]byte, size)
+			io.ReadFull(reader, username)
+		}
+		password := make([]byte, 0)
+		if size, err := reader.ReadByte(); err == nil {
+			password = make([]byte, size)
+			io.ReadFull(reader, password)
+		}
+		if version != socksPasswordVersion || string(username) != p.username || string(password) != p.password {
+			conn.Write([]byte{socksPasswordVersion, 1})
+			return
+		}
+		conn.Write([]byte{socksPasswordVersion, socksReplySucceeded})
+	}
+
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	destination, err := readSocksDestination(conn)
+	if err != nil {
+		return
+	}
+
+	switch header[1] {
+	case socksCommandConnect:
+		p.record(destination)
+		target, err := net.Dial("tcp", destination)
+		if err != nil {
+			conn.Write([]byte{socksVersion, 5, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer target.Close()
+		conn.Write([]byte{socksVersion, socksReplySucceeded, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+		go io.Copy(target, conn)
+		io.Copy(conn, target)
+
+	case socksCommandAssociate:
+		relay, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			return
+		}
+		defer relay.Close()
+		reply := []byte{socksVersion, socksReplySucceeded, 0}
+		reply, _ = appendSocksAddr(reply, relay.LocalAddr().String())
+		conn.Write(reply)
+		go p.relayUDP(relay)
+		// the relay lives as long as the control connection
+		io.Copy(io.Discard, conn)
+	}
+}
+
+func (p *fakeSocksProxy) relayUDP(relay net.PacketConn) {
+	var client net.Addr
+	buffer := make([]byte, 64*1024)
+	for {
+		read, from, err := relay.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		if client == nil || from.String() == client.String() {
+			client = from
+			reader := bytes.NewReader(buffer[3:read])
+			destination, err := readSocksDestination(reader)
+			if err != nil {
+				continue
+			}
+			p.record(destination)
+			target, err := net.ResolveUDPAddr("udp4", destination)
+			if err != nil {
+				continue
+			}
+			relay.WriteTo(buffer[read-reader.Len():read], target)
+			continue
+		}
+		packet, _ := appendSocksAddr([]byte{0, 0, 0}, from.String())
+		relay.WriteTo(append(packet, buffer[:read]...), client)
+	}
+}
+
+// newFakeHTTPProxy starts an HTTP proxy that only supports CONNECT.
+func newFakeHTTPProxy(t *testing.T) string {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				request, err := http.ReadRequest(reader)
+				if err != nil || request.Method != http.MethodConnect {
+					return
+				}
+				target, err := net.Dial("tcp", request.Host)
+				if err != nil {
+					io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer target.Close()
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(target, reader)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	return "http://" + listener.Addr().String()
+}
+
+func newEchoServer(t *testing.T) int {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func expectEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "ping" {
+		t.Errorf("echo returned %q", reply)
+	}
+}
+
+func TestProxyDialerConnect(t *testing.T) {
+	port := strconv.Itoa(newEchoServer(t))
+	socks := newFakeSocksProxy(t, "user", "secret")
+
+	for _, proxyURL := range []string{socks.url(), newFakeHTTPProxy(t)} {
+		dialer, err := newProxyDialer(proxyURL, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := dialer.DialContext(context.Background(), "tcp", "localhost:"+port)
+		if err != nil {
+			t.Fatalf("dial through %s: %v", proxyURL, err)
+		}
+		expectEcho(t, conn)
+	}
+	if got := socks.destinations(); !slices.Equal(got, []string{"localhost:" + port}) {
+		t.Errorf("socks proxy was asked for %v, want the host name", got)
+	}
+}
+
+func TestProxyDialerRejectsBadCredentials(t *testing.T) {
+	socks := newFakeSocksProxy(t, "user", "secret")
+	u, _ := url.Parse(socks.url())
+	u.User = url.UserPassword("user", "wrong")
+	dialer, err := newProxyDialer(u.String(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dialer.DialContext(context.Background(), "tcp", "127.0.0.1:1"); err == nil {
+		t.Fatal("dial succeeded with wrong credentials")
+	}
+}
+
+func TestProxyDialerRelaysUDP(t *testing.T) {
+	socks := newFakeSocksProxy(t, "", "")
+	fake := newFakeUDPTracker(t, func(f *fakeUDPTracker) {
+		f.peers = []Peer{{Addr: netip.MustParseAddr("10.0.0.1"), Port: 6881}}
+	})
+	port := fake.conn.LocalAddr().(*net.UDPAddr).Port
+	hostPort := "localhost:" + strconv.Itoa(port)
+
+	dialer, err := newProxyDialer(socks.url(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := dialer.ResolveUDPAddr("udp", hostPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := addr.(hostAddr); !ok {
+		t.Fatalf("host name was resolved locally to %v", addr)
+	}
+	conn, err := dialer.ListenUDP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := &UDPTracker{conn: conn, addr: addr, timeout: time.Second}
+	defer tracker.Close()
+
+	response, err := tracker.Request(udpActionAnnounce, make([]byte, 82))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tracker.isIPv6() {
+		t.Error("tracker answering from an IPv4 address is treated as IPv6")
+	}
+	if peers := parseCompactPeers(response[12:], net.IPv4len); len(peers) != 1 || peers[0].Port != 6881 {
+		t.Errorf("peers %v", peers)
+	}
+	for _, destination := range socks.destinations() {
+		if destination != "0.0.0.0:0" && destination != hostPort {
+			t.Errorf("socks proxy was asked for %s, want %s", destination, hostPort)
+		}
+	}
+}
+
+func TestProxyDialerDropsDatagramsNotFromRelay(t *testing.T) {
+	socks := newFakeSocksProxy(t, "", "")
+	dialer, err := newProxyDialer(socks.url(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.ListenUDP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	echo, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buffer := make([]byte, 1500)
+		read, from, err := echo.ReadFrom(buffer)
+		if err == nil {
+			echo.WriteTo(buffer[:read], from)
+		}
+	}()
+
+	// a datagram with a valid header, sent straight to our socket
+	attacker, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer attacker.Close()
+	forged, _ := appendSocksAddr([]byte{0, 0, 0}, echo.LocalAddr().String())
+	local := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), uint16(conn.LocalAddr().(*net.UDPAddr).Port))
+	if _, err := attacker.WriteTo(append(forged, "forged"...), net.UDPAddrFromAddrPort(local)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := conn.WriteTo([]byte("relayed"), echo.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buffer := make([]byte, 1500)
+	read, _, err := conn.ReadFrom(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buffer[:read]); got != "relayed" {
+		t.Errorf("read %q, want the datagram that came through the relay", got)
+	}
+}
+
+func TestDHTBootstrapThroughProxy(t *testing.T) {
+	socks := newFakeSocksProxy(t, "", "")
+	router, err := listenDHT("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+
+	dialer, err := newProxyDialer(socks.url(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.ListenUDP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := newDHT(conn)
+	defer node.Close()
+
+	routerAddr := "localhost:" + strconv.Itoa(int(router.Addr().Port()))
+	addr, err := dialer.ResolveUDPAddr("udp4", routerAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := node.queryAddr(addr, "ping", krpcArgs{}); err != nil {
+		t.Fatal(err)
+	}
+	if closest := node.table.Closest(router.id, 1); len(closest) != 1 || closest[0].Addr != router.Addr() {
+		t.Errorf("router not added to the routing table by its address: %v", closest)
+	}
+	if !slices.Contains(socks.destinations(), routerAddr) {
+		t.Errorf("socks proxy was asked for %v, want %s", socks.destinations(), routerAddr)
+	}
+}
+
+func TestProxyOnlyRefusesLocalDNS(t *testing.T) {
+	httpOnly, err := newProxyDialer("http://127.0.0.1:3128", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := httpOnly.ResolveUDPAddr("udp", "tracker.example:6969"); !errors.Is(err, errDirectConnection) {
+		t.Errorf("udp host name through an http proxy: got %v, want %v", err, errDirectConnection)
+	}
+	if _, err := httpOnly.ListenUDP(); !errors.Is(err, errDirectConnection) {
+		t.Errorf("udp through an http proxy: got %v, want %v", err, errDirectConnection)
+	}
+
+	for _, dialer := range []*ProxyDialer{
+		{URL: &url.URL{Scheme: "socks5", Host: "127.0.0.1:1080"}, Only: true},
+		{URL: &url.URL{Scheme: "socks5h", Host: "127.0.0.1:1080"}},
+	} {
+		if _, err := dialer.LookupHost("peer.example"); !errors.Is(err, errDirectConnection) {
+			t.Errorf("%s lookup: got %v, want %v", dialer.URL.Scheme, err, errDirectConnection)
+		}
+		if addr, err := dialer.ResolveUDPAddr("udp", "127.0.0.1:6969"); err != nil || addr.String() != "127.0.0.1:6969" {
+			t.Errorf("%s resolving an address literal: got %v, %v", dialer.URL.Scheme, addr, err)
+		}
+	}
+
+	direct := &ProxyDialer{URL: &url.URL{Scheme: "socks5", Host: "127.0.0.1:1080"}}
+	if addr, err := direct.ResolveUDPAddr("udp4", "localhost:6969"); err != nil {
+		t.Error(err)
+	} else if _, ok := addr.(*net.UDPAddr); !ok {
+		t.Errorf("socks5 without proxy-only mode should resolve locally, got %T", addr)
+	}
+}
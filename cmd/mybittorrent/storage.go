@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// StorageFile is one file of a torrent together with the position it takes up
+// in the contiguous stream of bytes that pieces are computed over. Padding
+// files are part of that stream but never written to disk.
+type StorageFile struct {
+	Path    string
+	Offset  int
+	Length  int
+	Padding bool
+}
+
+// fileSpan is the part of a StorageFile covered by some range of torrent data.
+type fileSpan struct {
+	file       *StorageFile
+	fileOffset int
+	dataOffset int
+	length     int
+}
+
+// Storage maps pieces onto the files of a torrent, so that a piece crossing a
+// file boundary is split between the files it covers.
+type Storage struct {
+	files       []StorageFile
+	pieceLength int
+	totalLength int
+}
+
+// newStorage lays out the files of info below root. A single-file torrent is
+// stored at root itself, a multi-file torrent in a directory named after the
+// torrent inside root. Torrents without v1 metadata start every file on a
+// piece boundary, as BEP 52 requires.
+func newStorage(root string, info *Info) (*Storage, error) {
+	storage := &Storage{pieceLength: info.PieceLength}
+
+	if !info.IsMultiFile() {
+		storage.files = []StorageFile{{Path: root, Length: info.TotalLength()}}
+		storage.totalLength = info.TotalLength()
+		return storage, nil
+	}
+
+	if err := validatePathSegment(info.Name); err != nil {
+		return nil, fmt.Errorf("invalid torrent name: %w", err)
+	}
+
+	var files []FileInfo
+	if info.HasV1() {
+		files = info.Files
+	} else {
+		for _, file := range info.V2Files() {
+			files = append(files, FileInfo{Length: file.Length, Path: file.Path})
+		}
+	}
+
+	for _, file := range files {
+		if len(file.Path) == 0 {
+			return nil, fmt.Errorf("file without a path")
+		}
+		for _, segment := range file.Path {
+			if err := validatePathSegment(segment); err != nil {
+				return nil, fmt.Errorf("invalid path %q: %w", strings.Join(file.Path, "/"), err)
+			}
+		}
+		if !info.HasV1() && storage.totalLength%info.PieceLength != 0 {
+			storage.totalLength += info.PieceLength - storage.totalLength%info.PieceLength
+		}
+		segments := append([]string{root, info.Name}, file.Path...)
+		storage.files = append(storage.files, StorageFile{
+			Path:    filepath.Join(segments...),
+			Offset:  storage.totalLength,
+			Length:  file.Length,
+			Padding: file.IsPadding(),
+		})
+		storage.totalLength += file.Length
+	}
+	return storage, nil
+}
+
+// validatePathSegment rejects names that would let a torrent write outside of
+// its own directory.
+func validatePathSegment(segment string) error {
+	switch {
+	case segment == "", segment == ".", segment == "..":
+		return fmt.Errorf("path segment %q is not allowed", segment)
+	case strings.ContainsAny(segment, "/\\\x00"):
+		return fmt.Errorf("path segment %q contains a separator", segment)
+	}
+	return nil
+}
+
+func (s *Storage) Files() []StorageFile {
+	return s.files
+}
+
+func (s *Storage) PieceCount() int {
+	return (s.totalLength + s.pieceLength - 1) / s.pieceLength
+}
+
+// PieceSize returns the length of the piece at index. Usually only the last
+// piece is shorter than the piece length, but in v2 torrents every file ends
+// with a short piece.
+func (s *Storage) PieceSize(index int) int {
+	var size int
+	for _, span := range s.spans(index*s.pieceLength, s.pieceLength) {
+		size += span.length
+	}
+	return size
+}
+
+// spans returns the file ranges covered by length bytes of torrent data
+// starting at offset.
+func (s *Storage) spans(offset int, length int) []fileSpan {
+	var spans []fileSpan
+	end := offset + length
+	for i := range s.files {
+		file := &s.files[i]
+		start := max(offset, file.Offset)
+		stop := min(end, file.Offset+file.Length)
+		if start >= stop {
+			continue
+		}
+		spans = append(spans, fileSpan{
+			file:       file,
+			fileOffset: start - file.Offset,
+			dataOffset: start - offset,
+			length:     stop - start,
+		})
+	}
+	return spans
+}
+
+// Create makes every file and its parent directories and sizes the files to
+// their final length, so empty files exist even though no piece touches them.
+func (s *Storage) Create() error {
+	for _, file := range s.files {
+		if file.Padding {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(file.Path), 0o755); err != nil {
+			return fmt.Errorf("unable to create directory for %s: %w", file.Path, err)
+		}
+		f, err := os.OpenFile(file.Path, os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return fmt.Errorf("unable to create %s: %w", file.Path, err)
+		}
+		err = f.Truncate(int64(file.Length))
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("unable to resize %s: %w", file.Path, err)
+		}
+	}
+	return nil
+}
+
+// WritePiece stores a verified piece in the files it covers.
+func (s *Storage) WritePiece(index int, data []byte) error {
+	for _, span := range s.spans(index*s.pieceLength, len(data)) {
+		if span.file.Padding {
+			continue
+		}
+		f, err := os.OpenFile(span.file.Path, os.O_WRONLY, 0)
+		if err != nil {
+			return fmt.Errorf("unable to open %s: %w", span.file.Path, err)
+		}
+		_, err = f.WriteAt(data[span.dataOffset:span.dataOffset+span.length], int64(span.fileOffset))
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("unable to write piece %d to %s: %w", index, span.file.Path, err)
+		}
+	}
+	return nil
+}
+
+// ReadPiece reads the piece at index back from the files it covers. Padding
+// is returned as zeros.
+func (s *Storage) ReadPiece(index int) ([]byte, error) {
+	data := make([]byte, s.PieceSize(index))
+	for _, span := range s.spans(index*s.pieceLength, len(data)) {
+		if span.file.Padding {
+			continue
+		}
+		f, err := os.Open(span.file.Path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open %s: %w", span.file.Path, err)
+		}
+		_, err = f.ReadAt(data[span.dataOffset:span.dataOffset+span.length], int64(span.fileOffset))
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read piece %d from %s: %w", index, span.file.Path, err)
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	trackerPeerID = "dededededededededede"
+	listenPort    = 6881
+	// defaultAnnounceInterval is used when a tracker does not say how often it
+	// wants to hear from us.
+	defaultAnnounceInterval = 30 * time.Minute
+	// maxTrackerResponseSize bounds what we read from an HTTP tracker.
+	maxTrackerResponseSize = 4 << 20
+)
+
+type AnnounceEvent string
+
+const (
+	EventNone      AnnounceEvent = ""
+	EventStarted   AnnounceEvent = "started"
+	EventCompleted AnnounceEvent = "completed"
+	EventStopped   AnnounceEvent = "stopped"
+)
+
+// AnnounceRequest holds the parameters sent to a tracker on announce.
+type AnnounceRequest struct {
+	InfoHash   []byte
+	PeerID     string
+	Port       int
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      AnnounceEvent
+	// NumWant is the number of peers asked for, or -1 for the tracker default.
+	NumWant int
+	Key     uint32
+	// TrackerID is the tracker id a tracker returned in an earlier response.
+	TrackerID string
+}
+
+func newAnnounceRequest(metainfo *Metainfo) *AnnounceRequest {
+	return &AnnounceRequest{
+		InfoHash: metainfo.InfoHash,
+		PeerID:   trackerPeerID,
+		Port:     listenPort,
+		Left:     int64(metainfo.Info.TotalLength()),
+		NumWant:  -1,
+		Key:      rand.Uint32(),
+	}
+}
+
+// AnnounceResponse is the answer of a tracker to an announce, independent of
+// the protocol used to talk to it.
+type AnnounceResponse struct {
+	Interval    time.Duration
+	MinInterval time.Duration
+	TrackerID   string
+	Seeders     int
+	Leechers    int
+	Peers       []Peer
+	// Warning is set when the tracker answered but attached a warning
+	// message.
+	Warning *TrackerWarningError
+}
+
+// TrackerFailureError is returned when a tracker refuses a request and
+// explains why in its failure reason.
+type TrackerFailureError struct {
+	Reason string
+}
+
+func (e *TrackerFailureError) Error() string {
+	return "tracker returned failure: " + e.Reason
+}
+
+// TrackerWarningError carries the warning message of a tracker response. The
+// response is still valid.
+type TrackerWarningError struct {
+	Message string
+}
+
+func (e *TrackerWarningError) Error() string {
+	return "tracker returned warning: " + e.Message
+}
+
+type TrackerResponse struct {
+	FailureReason  string `bencode:"failure reason,omitempty"`
+	WarningMessage string `bencode:"warning message,omitempty"`
+	Interval       int    `bencode:"interval,omitempty"`
+	MinInterval    int    `bencode:"min interval,omitempty"`
+	TrackerID      string `bencode:"tracker id,omitempty"`
+	Complete       int    `bencode:"complete,omitempty"`
+	Incomplete     int    `bencode:"incomplete,omitempty"`
+	// Peers is either a compact string of IPv4 peers or a list of
+	// dictionaries (BEP 23).
+	Peers  RawMessage `bencode:"peers,omitempty"`
+	Peers6 []byte     `bencode:"peers6,omitempty"`
+}
+
+// TrackerPeer is an entry of a non-compact peer list.
+type TrackerPeer struct {
+	PeerID []byte `bencode:"peer id,omitempty"`
+	IP     string `bencode:"ip,required"`
+	Port   int    `bencode:"port,required"`
+}
+
+type ScrapeResponse struct {
+	FailureReason string                 `bencode:"failure reason,omitempty"`
+	Files         map[string]ScrapeStats `bencode:"files,omitempty"`
+}
+
+// ScrapeStats describes the swarm of one torrent as reported by a tracker.
+type ScrapeStats struct {
+	Complete   int `bencode:"complete"`
+	Downloaded int `bencode:"downloaded"`
+	Incomplete int `bencode:"incomplete"`
+}
+
+// TrackerTiers holds the trackers of a torrent grouped in tiers (BEP 12).
+// Trackers are shuffled within their tier once, and a tracker that answers is
+// moved to the front of its tier so it is tried first next time.
+type TrackerTiers struct {
+	mu    sync.Mutex
+	tiers [][]string
+}
+
+func newTrackerTiers(metainfo *Metainfo) *TrackerTiers {
+	t := &TrackerTiers{}
+	for _, tier := range metainfo.AnnounceList {
+		tier = slices.DeleteFunc(slices.Clone(tier), func(trackerURL string) bool { return trackerURL == "" })
+		if len(tier) == 0 {
+			continue
+		}
+		rand.Shuffle(len(tier), func(i, j int) { tier[i], tier[j] = tier[j], tier[i] })
+		t.tiers = append(t.tiers, tier)
+	}
+	// The announce key is only used when there is no announce-list.
+	if len(t.tiers) == 0 && metainfo.Announce != "" {
+		t.tiers = [][]string{{metainfo.Announce}}
+	}
+	return t
+}
+
+func (t *TrackerTiers) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var count int
+	for _, tier := range t.tiers {
+		count += len(tier)
+	}
+	return count
+}
+
+// URLs returns every tracker in the order they would be tried.
+func (t *TrackerTiers) URLs() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var urls []string
+	for _, tier := range t.tiers {
+		urls = append(urls, tier...)
+	}
+	return urls
+}
+
+// Announce calls announce for trackers in tier order. Unless all is set it
+// stops at the first tracker that answers, as BEP 12 prescribes; with all set
+// every tracker is asked at once and the peers are merged in tier order.
+// Duplicate peers are dropped. An error is only returned if no tracker
+// answered. The tiers are not locked while announcing, so a slow tracker
+// does not hold up other callers.
+func (t *TrackerTiers) Announce(announce func(trackerURL string) ([]Peer, error), all bool) ([]Peer, error) {
+	t.mu.Lock()
+	tiers := make([][]string, len(t.tiers))
+	for i, tier := range t.tiers {
+		tiers[i] = slices.Clone(tier)
+	}
+	t.mu.Unlock()
+
+	if len(tiers) == 0 {
+		return nil, errors.New("torrent has no trackers")
+	}
+
+	type result struct {
+		peers []Peer
+		err   error
+	}
+	// With all set, every tracker is asked before the first answer is read.
+	var pending [][]chan result
+	if all {
+		pending = make([][]chan result, len(tiers))
+		for tierIndex, tier := range tiers {
+			for _, trackerURL := range tier {
+				done := make(chan result, 1)
+				go func() {
+					peers, err := announce(trackerURL)
+					done <- result{peers, err}
+				}()
+				pending[tierIndex] = append(pending[tierIndex], done)
+			}
+		}
+	}
+
+	var peers []Peer
+	var errs []error
+	seen := make(map[netip.AddrPort]bool)
+	answered := false
+	for tierIndex, tier := range tiers {
+		for i, trackerURL := range tier {
+			var r result
+			if all {
+				r = <-pending[tierIndex][i]
+			} else {
+				r.peers, r.err = announce(trackerURL)
+			}
+			if r.err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", trackerURL, r.err))
+				continue
+			}
+			t.promote(tierIndex, trackerURL)
+			answered = true
+
+			for _, peer := range r.peers {
+				if !seen[peer.AddrPort()] {
+					seen[peer.AddrPort()] = true
+					peers = append(peers, peer)
+				}
+			}
+			if !all {
+				return peers, nil
+			}
+		}
+	}
+
+	if !answered {
+		return nil, errors.Join(errs...)
+	}
+	return peers, nil
+}
+
+// promote moves a tracker that answered to the front of its tier.
+func (t *TrackerTiers) promote(tierIndex int, trackerURL string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tier := t.tiers[tierIndex]
+	if i := slices.Index(tier, trackerURL); i > 0 {
+		copy(tier[1:i+1], tier[:i])
+		tier[0] = trackerURL
+	}
+}
+
+func getPeersFromMetainfo(metainfo *Metainfo) ([]Peer, error) {
+	request := newAnnounceRequest(metainfo)
+	return withLocalPeers(metainfo.InfoHash, func() ([]Peer, error) {
+		return newTrackerTiers(metainfo).Announce(func(trackerURL string) ([]Peer, error) {
+			response, err := announce(trackerURL, request)
+			if err != nil {
+				return nil, err
+			}
+			return response.Peers, nil
+		}, false)
+	})
+}
+
+// getPeersFromAllTrackers asks every tracker of the torrent for peers and
+// merges the results, along with any peers found on the local network.
+func getPeersFromAllTrackers(metainfo *Metainfo) ([]Peer, error) {
+	request := newAnnounceRequest(metainfo)
+	return withLocalPeers(metainfo.InfoHash, func() ([]Peer, error) {
+		return newTrackerTiers(metainfo).Announce(func(trackerURL string) ([]Peer, error) {
+			response, err := announce(trackerURL, request)
+			if err != nil {
+				return nil, err
+			}
+			return response.Peers, nil
+		}, true)
+	})
+}
+
+// announce asks a single tracker for peers, picking the protocol from the
+// scheme of its URL.
+func announce(trackerURL string, request *AnnounceRequest) (*AnnounceResponse, error) {
+	u, err := url.Parse(trackerURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid announce url: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return announceHTTP(u, request)
+	case "udp":
+		return announceUDP(u, request)
+	default:
+		return nil, fmt.Errorf("unsupported tracker protocol %q", u.Scheme)
+	}
+}
+
+func announceHTTP(u *url.URL, request *AnnounceRequest) (*AnnounceResponse, error) {
+	params := u.Query()
+	params.Add("info_hash", string(request.InfoHash))
+	params.Add("peer_id", request.PeerID)
+	params.Add("port", strconv.Itoa(request.Port))
+	params.Add("uploaded", strconv.FormatInt(request.Uploaded, 10))
+	params.Add("downloaded", strconv.FormatInt(request.Downloaded, 10))
+	params.Add("left", strconv.FormatInt(request.Left, 10))
+	params.Add("compact", "1")
+	if request.Event != EventNone {
+		params.Add("event", string(request.Event))
+	}
+	if request.NumWant >= 0 {
+		params.Add("numwant", strconv.Itoa(request.NumWant))
+	}
+	params.Add("key", strconv.FormatUint(uint64(request.Key), 16))
+	if request.TrackerID != "" {
+		params.Add("trackerid", request.TrackerID)
+	}
+	u.RawQuery = params.Encode()
+
+	body, err := getTrackerResponse(u)
+	if err != nil {
+		return nil, fmt.Errorf("unable to request peers: %w", err)
+	}
+
+	var trackerResponse TrackerResponse
+	if err := Unmarshal(body, &trackerResponse); err != nil {
+		return nil, fmt.Errorf("unable to decode peers body %w", err)
+	}
+	if trackerResponse.FailureReason != "" {
+		return nil, &TrackerFailureError{Reason: trackerResponse.FailureReason}
+	}
+	peers, err := parseTrackerPeers(trackerResponse.Peers)
+	if err != nil {
+		return nil, err
+	}
+	peers = append(peers, parseCompactPeers(trackerResponse.Peers6, net.IPv6len)...)
+
+	response := &AnnounceResponse{
+		Interval:    time.Duration(trackerResponse.Interval) * time.Second,
+		MinInterval: time.Duration(trackerResponse.MinInterval) * time.Second,
+		TrackerID:   trackerResponse.TrackerID,
+		Seeders:     trackerResponse.Complete,
+		Leechers:    trackerResponse.Incomplete,
+		Peers:       peers,
+	}
+	if trackerResponse.WarningMessage != "" {
+		response.Warning = &TrackerWarningError{Message: trackerResponse.WarningMessage}
+	}
+	return response, nil
+}
+
+// parseTrackerPeers decodes the peers key of an HTTP tracker response, which
+// is compact or a list of dictionaries depending on the tracker.
+func parseTrackerPeers(raw RawMessage) ([]Peer, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	if raw[0] != 'l' {
+		var compact []byte
+		if err := Unmarshal(raw, &compact); err != nil {
+			return nil, fmt.Errorf("unable to decode compact peers: %w", err)
+		}
+		return parseCompactPeers(compact, net.IPv4len), nil
+	}
+
+	var trackerPeers []TrackerPeer
+	if err := Unmarshal(raw, &trackerPeers); err != nil {
+		return nil, fmt.Errorf("unable to decode peer list: %w", err)
+	}
+	peers := make([]Peer, 0, len(trackerPeers))
+	for _, trackerPeer := range trackerPeers {
+		if trackerPeer.Port <= 0 || trackerPeer.Port > math.MaxUint16 {
+			continue
+		}
+		addr, err := netip.ParseAddr(trackerPeer.IP)
+		if err != nil {
+			// The ip key may also hold a DNS name.
+			if addr, err = lookupHost(trackerPeer.IP); err != nil {
+				continue
+			}
+		}
+		peers = append(peers, Peer{
+			Addr: addr.Unmap(),
+			Port: uint16(trackerPeer.Port),
+			ID:   trackerPeer.PeerID,
+		})
+	}
+	return peers, nil
+}
+
+// parseCompactPeers decodes a list of peers packed as an addrLen byte address
+// followed by a 2 byte port, as trackers send them in compact form.
+func parseCompactPeers(rawPeers []byte, addrLen int) []Peer {
+	peerLen := addrLen + 2
+	peersCount := len(rawPeers) / peerLen
+	peers := make([]Peer, 0, peersCount)
+	for i := 0; i < peersCount; i++ {
+		rawPeer := rawPeers[i*peerLen : (i+1)*peerLen]
+		addr, _ := netip.AddrFromSlice(rawPeer[:addrLen])
+		peers = append(peers, Peer{
+			Addr: addr.Unmap(),
+			Port: binary.BigEndian.Uint16(rawPeer[addrLen:]),
+		})
+	}
+	return peers
+}
+
+// scrape asks a single tracker for the swarm stats of each info hash. The
+// result has one entry per info hash, zero for torrents the tracker does not
+// know about.
+func scrape(trackerURL string, infoHashes [][]byte) ([]ScrapeStats, error) {
+	u, err := url.Parse(trackerURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid announce url: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return scrapeHTTP(u, infoHashes)
+	case "udp":
+		return scrapeUDP(u, infoHashes)
+	default:
+		return nil, fmt.Errorf("unsupported tracker protocol %q", u.Scheme)
+	}
+}
+
+// scrapeURL derives the scrape URL of an HTTP tracker from its announce URL
+// by replacing "announce" at the start of the last path segment with
+// "scrape". Trackers whose announce URL does not follow that convention do
+// not support scraping.
+func scrapeURL(announceURL *url.URL) (*url.URL, error) {
+	slash := strings.LastIndex(announceURL.Path, "/")
+	last := announceURL.Path[slash+1:]
+	if !strings.HasPrefix(last, "announce") {
+		return nil, fmt.Errorf("tracker %s does not support scrape", announceURL)
+	}
+	u := *announceURL
+	u.Path = announceURL.Path[:slash+1] + "scrape" + strings.TrimPrefix(last, "announce")
+	u.RawPath = ""
+	return &u, nil
+}
+
+func scrapeHTTP(announceURL *url.URL, infoHashes [][]byte) ([]ScrapeStats, error) {
+	u, err := scrapeURL(announceURL)
+	if err != nil {
+		return nil, err
+	}
+	params := u.Query()
+	for _, infoHash := range infoHashes {
+		params.Add("info_hash", string(infoHash))
+	}
+	u.RawQuery = params.Encode()
+
+	body, err := getTrackerResponse(u)
+	if err != nil {
+		return nil, fmt.Errorf("unable to request scrape: %w", err)
+	}
+
+	var scrapeResponse ScrapeResponse
+	if err := Unmarshal(body, &scrapeResponse); err != nil {
+		return nil, fmt.Errorf("unable to decode scrape body %w", err)
+	}
+	if scrapeResponse.FailureReason != "" {
+		return nil, &TrackerFailureError{Reason: scrapeResponse.FailureReason}
+	}
+
+	stats := make([]ScrapeStats, len(infoHashes))
+	for i, infoHash := range infoHashes {
+		stats[i] = scrapeResponse.Files[string(infoHash)]
+	}
+	return stats, nil
+}
+
+// getTrackerResponse fetches u from an HTTP tracker, rejecting error statuses
+// and bodies larger than maxTrackerResponseSize.
+func getTrackerResponse(u *url.URL) ([]byte, error) {
+	resp, err := trackerHTTPClient.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("tracker answered with status %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxTrackerResponseSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read response body: %w", err)
+	}
+	if len(body) > maxTrackerResponseSize {
+		return nil, fmt.Errorf("tracker response exceeds %d bytes", maxTrackerResponseSize)
+	}
+	return body, nil
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultNumWant = 50
+	maxNumWant     = 200
+)
+
+var (
+	errTorrentNotAllowed = errors.New("torrent is not served by this tracker")
+	errInvalidInfoHash   = errors.New("invalid info_hash")
+	errInvalidPeerID     = errors.New("invalid peer_id")
+	errInvalidPort       = errors.New("invalid port")
+)
+
+type swarmPeer struct {
+	Peer
+	left     int64
+	lastSeen time.Time
+}
+
+type swarm struct {
+	peers      map[netip.AddrPort]*swarmPeer
+	downloaded int
+}
+
+// stats counts seeders and leechers; callers hold the server lock.
+func (s *swarm) stats() ScrapeStats {
+	stats := ScrapeStats{Downloaded: s.downloaded}
+	for _, peer := range s.peers {
+		if peer.left == 0 {
+			stats.Complete++
+		} else {
+			stats.Incomplete++
+		}
+	}
+	return stats
+}
+
+// TrackerServer is an in-memory tracker. Peers that have not announced for
+// two intervals are considered gone, and a swarm is forgotten once its last
+// peer is. When allowed is set, only the torrents it contains are tracked.
+type TrackerServer struct {
+	mu        sync.Mutex
+	swarms    map[string]*swarm
+	allowed   map[string]bool
+	interval  time.Duration
+	lastSweep time.Time
+
+	// udpSecret keys the connection IDs handed out to UDP clients, so
+	// they can be checked without keeping state per client.
+	udpSecret []byte
+}
+
+func newTrackerServer(interval time.Duration, allowed [][]byte) *TrackerServer {
+	s := &TrackerServer{
+		swarms:    make(map[string]*swarm),
+		interval:  interval,
+		udpSecret: make([]byte, 32),
+	}
+	rand.Read(s.udpSecret)
+	if len(allowed) > 0 {
+		s.allowed = make(map[string]bool)
+		for _, infoHash := range allowed {
+			s.allowed[string(infoHash)] = true
+		}
+	}
+	return s
+}
+
+// serverAnnounce is an announce as received by the server, from HTTP or UDP.
+type serverAnnounce struct {
+	infoHash []byte
+	peer     Peer
+	left     int64
+	event    AnnounceEvent
+	numWant  int
+}
+
+// announce records the peer in its swarm and returns up to numWant other
+// peers along with the swarm stats.
+func (s *TrackerServer) announce(request serverAnnounce) ([]Peer, ScrapeStats, error) {
+	if len(request.infoHash) != sha1.Size {
+		return nil, ScrapeStats{}, errInvalidInfoHash
+	}
+	if s.allowed != nil && !s.allowed[string(request.infoHash)] {
+		return nil, ScrapeStats{}, errTorrentNotAllowed
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep()
+
+	current, ok := s.swarms[string(request.infoHash)]
+	if !ok {
+		current = &swarm{peers: make(map[netip.AddrPort]*swarmPeer)}
+		s.swarms[string(request.infoHash)] = current
+	}
+
+	key := request.peer.AddrPort()
+	if request.event == EventStopped {
+		delete(current.peers, key)
+	} else {
+		if request.event == EventCompleted {
+			current.downloaded++
+		}
+		current.peers[key] = &swarmPeer{Peer: request.peer, left: request.left, lastSeen: time.Now()}
+	}
+	s.expire(string(request.infoHash), current)
+
+	numWant := request.numWant
+	if numWant < 0 {
+		numWant = defaultNumWant
+	}
+	numWant = min(numWant, maxNumWant)
+
+	// Map iteration order is random enough to hand out a different subset of
+	// a large swarm on every announce.
+	peers := make([]Peer, 0, min(numWant, len(current.peers)))
+	for peerKey, peer := range current.peers {
+		if len(peers) == numWant {
+			break
+		}
+		if peerKey != key {
+			peers = append(peers, peer.Peer)
+		}
+	}
+	return peers, current.stats(), nil
+}
+
+// scrape returns the stats of the requested torrents, or of every torrent
+// when infoHashes is empty.
+func (s *TrackerServer) scrape(infoHashes [][]byte) map[string]ScrapeStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files := make(map[string]ScrapeStats)
+	if len(infoHashes) == 0 {
+		for infoHash, current := range s.swarms {
+			if s.expire(infoHash, current) {
+				files[infoHash] = current.stats()
+			}
+		}
+		return files
+	}
+	for _, infoHash := range infoHashes {
+		if s.allowed != nil && !s.allowed[string(infoHash)] {
+			continue
+		}
+		var stats ScrapeStats
+		if current, ok := s.swarms[string(infoHash)]; ok && s.expire(string(infoHash), current) {
+			stats = current.stats()
+		}
+		files[string(infoHash)] = stats
+	}
+	return files
+}
+
+// expire drops the peers of a swarm that stopped announcing, and the swarm
+// itself when no peer is left. It reports whether the swarm is still
+// tracked; callers hold the server lock.
+func (s *TrackerServer) expire(infoHash string, current *swarm) bool {
+	deadline := time.Now().Add(-2 * s.interval)
+	for key, peer := range current.peers {
+		if peer.lastSeen.Before(deadline) {
+			delete(current.peers, key)
+		}
+	}
+	if len(current.peers) == 0 {
+		delete(s.swarms, infoHash)
+		return false
+	}
+	return true
+}
+
+// sweep expires every swarm once per interval, so that swarms nobody
+// announces to any more are forgotten too; callers hold the server lock.
+func (s *TrackerServer) sweep() {
+	if time.Since(s.lastSweep) < s.interval {
+		return
+	}
+	s.lastSweep = time.Now()
+	for infoHash, current := range s.swarms {
+		s.expire(infoHash, current)
+	}
+}
+
+func (s *TrackerServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/announce", s.serveAnnounce)
+	mux.HandleFunc("/scrape", s.serveScrape)
+	return mux
+}
+
+func (s *TrackerServer) serveAnnounce(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	remote, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		writeTrackerFailure(w, "unable to determine peer address")
+		return
+	}
+	peerID := []byte(params.Get("peer_id"))
+	if len(peerID) != 20 {
+		writeTrackerFailure(w, errInvalidPeerID.Error())
+		return
+	}
+	port, err := strconv.ParseUint(params.Get("port"), 10, 16)
+	if err != nil || port == 0 {
+		writeTrackerFailure(w, errInvalidPort.Error())
+		return
+	}
+	left, _ := strconv.ParseInt(params.Get("left"), 10, 64)
+	numWant := -1
+	if params.Has("numwant") {
+		numWant, _ = strconv.Atoi(params.Get("numwant"))
+	}
+
+	peers, stats, err := s.announce(serverAnnounce{
+		infoHash: []byte(params.Get("info_hash")),
+		peer:     Peer{Addr: remote.Addr().Unmap(), Port: uint16(port), ID: peerID},
+		left:     left,
+		event:    AnnounceEvent(params.Get("event")),
+		numWant:  numWant,
+	})
+	if err != nil {
+		writeTrackerFailure(w, err.Error())
+		return
+	}
+
+	response := TrackerResponse{
+		Interval:   int(s.interval / time.Second),
+		Complete:   stats.Complete,
+		Incomplete: stats.Incomplete,
+	}
+	if params.Get("compact") == "1" {
+		var peers4, peers6 []byte
+		for _, peer := range peers {
+			if peer.Addr.Is4() {
+				peers4 = appendCompactPeer(peers4, peer)
+			} else {
+				peers6 = appendCompactPeer(peers6, peer)
+			}
+		}
+		response.Peers, err = Marshal(peers4)
+		response.Peers6 = peers6
+	} else {
+		noPeerID := params.Get("no_peer_id") == "1"
+		trackerPeers := make([]TrackerPeer, 0, len(peers))
+		for _, peer := range peers {
+			trackerPeer := TrackerPeer{IP: peer.Addr.String(), Port: int(peer.Port)}
+			if !noPeerID {
+				trackerPeer.PeerID = peer.ID
+			}
+			trackerPeers = append(trackerPeers, trackerPeer)
+		}
+		response.Peers, err = Marshal(trackerPeers)
+	}
+	if err != nil {
+		writeTrackerFailure(w, "unable to encode peers")
+		return
+	}
+	writeBencode(w, response)
+}
+
+func (s *TrackerServer) serveScrape(w http.ResponseWriter, r *http.Request) {
+	var infoHashes [][]byte
+	for _, infoHash := range r.URL.Query()["info_hash"] {
+		infoHashes = append(infoHashes, []byte(infoHash))
+	}
+	writeBencode(w, ScrapeResponse{Files: s.scrape(infoHashes)})
+}
+
+func writeTrackerFailure(w http.ResponseWriter, reason string) {
+	writeBencode(w, TrackerResponse{FailureReason: reason})
+}
+
+func writeBencode(w http.ResponseWriter, v any) {
+	encoded, err := Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(encoded)
+}
+
+func appendCompactPeer(b []byte, peer Peer) []byte {
+	b = append(b, peer.Addr.AsSlice()...)
+	return binary.BigEndian.AppendUint16(b, peer.Port)
+}
+
+// ServeUDP answers UDP tracker requests (BEP 15) on conn until it is closed.
+func (s *TrackerServer) ServeUDP(conn net.PacketConn) error {
+	buffer := make([]byte, 64*1024)
+	for {
+		read, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return err
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok || read < 16 {
+			continue
+		}
+		response := s.handleUDP(buffer[:read], udpAddr.AddrPort())
+		if response != nil {
+			conn.WriteTo(response, addr)
+		}
+	}
+}
+
+func (s *TrackerServer) handleUDP(packet []byte, remote netip.AddrPort) []byte {
+	connectionID := binary.BigEndian.Uint64(packet[0:8])
+	action := binary.BigEndian.Uint32(packet[8:12])
+	transactionID := packet[12:16]
+	payload := packet[16:]
+
+	response := binary.BigEndian.AppendUint32(nil, action)
+	response = append(response, transactionID...)
+	udpError := func(message string) []byte {
+		response := binary.BigEndian.AppendUint32(nil, udpActionError)
+		response = append(response, transactionID...)
+		return append(response, message...)
+	}
+
+	if action == udpActionConnect {
+		if connectionID != udpProtocolID {
+			return nil
+		}
+		return binary.BigEndian.AppendUint64(response, s.newUDPConnectionID(remote))
+	}
+	if !s.validUDPConnectionID(connectionID, remote) {
+		return udpError("invalid connection id")
+	}
+
+	switch action {
+	case udpActionAnnounce:
+		if len(payload) < 82 {
+			return udpError("announce request too short")
+		}
+		var event AnnounceEvent
+		for name, code := range udpAnnounceEvents {
+			if code == binary.BigEndian.Uint32(payload[64:68]) {
+				event = name
+			}
+		}
+		peers, stats, err := s.announce(serverAnnounce{
+			infoHash: payload[0:20],
+			peer: Peer{
+				Addr: remote.Addr().Unmap(),
+				Port: binary.BigEndian.Uint16(payload[80:82]),
+				ID:   bytes.Clone(payload[20:40]),
+			},
+			left:    int64(binary.BigEndian.Uint64(payload[48:56])),
+			event:   event,
+			numWant: int(int32(binary.BigEndian.Uint32(payload[76:80]))),
+		})
+		if err != nil {
+			return udpError(err.Error())
+		}
+		response = binary.BigEndian.AppendUint32(response, uint32(s.interval/time.Second))
+		response = binary.BigEndian.AppendUint32(response, uint32(stats.Incomplete))
+		response = binary.BigEndian.AppendUint32(response, uint32(stats.Complete))
+		// Peers are sent in the address family the request came in with.
+		for _, peer := range peers {
+			if peer.Addr.Is4() == remote.Addr().Unmap().Is4() {
+				response = appendCompactPeer(response, peer)
+			}
+		}
+		return response
+
+	case udpActionScrape:
+		var infoHashes [][]byte
+		for offset := 0; offset+sha1.Size <= len(payload) && len(infoHashes) < udpScrapeMaxHashes; offset += sha1.Size {
+			infoHashes = append(infoHashes, payload[offset:offset+sha1.Size])
+		}
+		files := s.scrape(infoHashes)
+		for _, infoHash := range infoHashes {
+			stats := files[string(infoHash)]
+			response = binary.BigEndian.AppendUint32(response, uint32(stats.Complete))
+			response = binary.BigEndian.AppendUint32(response, uint32(stats.Downloaded))
+			response = binary.BigEndian.AppendUint32(response, uint32(stats.Incomplete))
+		}
+		return response
+
+	default:
+		return udpError("unknown action")
+	}
+}
+
+// newUDPConnectionID hands out the connection ID of a client for the
+// current minute. It is a MAC of the client IP address and the minute, so a
+// flood of connect requests from forged addresses costs no memory. The port
+// is left out, as clients reuse the ID from other sockets.
+func (s *TrackerServer) newUDPConnectionID(remote netip.AddrPort) uint64 {
+	return s.udpConnectionID(remote, udpConnectionWindow(time.Now()))
+}
+
+// validUDPConnectionID accepts the connection IDs of the current and the
+// previous minute, giving clients at least the one minute they may use an
+// ID for.
+func (s *TrackerServer) validUDPConnectionID(id uint64, remote netip.AddrPort) bool {
+	window := udpConnectionWindow(time.Now())
+	return id == s.udpConnectionID(remote, window) || id == s.udpConnectionID(remote, window-1)
+}
+
+func udpConnectionWindow(now time.Time) int64 {
+	return now.UnixNano() / int64(udpConnectionIDLifetime)
+}
+
+func (s *TrackerServer) udpConnectionID(remote netip.AddrPort, window int64) uint64 {
+	mac := hmac.New(sha256.New, s.udpSecret)
+	binary.Write(mac, binary.BigEndian, window)
+	mac.Write(remote.Addr().Unmap().AsSlice())
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
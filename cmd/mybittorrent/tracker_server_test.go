@@ -0,0 +1,195 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startTrackerServer(t *testing.T, server *TrackerServer) (httpURL, udpURL string) {
+	httpServer := httptest.NewServer(server.Handler())
+	t.Cleanup(httpServer.Close)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go server.ServeUDP(conn)
+	return httpServer.URL + "/announce", "udp://" + conn.LocalAddr().String()
+}
+
+// captureStdout returns what fn prints to standard output.
+func captureStdout(t *testing.T, fn func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	output := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		output <- string(data)
+	}()
+	fn()
+	w.Close()
+	return <-output
+}
+
+func writeTestTorrent(t *testing.T, announceList [][]string) (string, []byte) {
+	rawInfo, err := Marshal(Info{Name: "file.bin", Length: 1, PieceLength: 16384, Pieces: make([]byte, 20)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := Marshal(Metainfo{AnnounceList: announceList, RawInfo: rawInfo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "test.torrent")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	metainfo, err := parseMetainfo(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, metainfo.InfoHash
+}
+
+func announceAs(t *testing.T, trackerURL string, infoHash []byte, peerID string, port int, event AnnounceEvent) {
+	request := &AnnounceRequest{InfoHash: infoHash, PeerID: peerID, Port: port, Left: 1, NumWant: 50, Event: event}
+	if _, err := announce(trackerURL, request); err != nil {
+		t.Fatalf("announce to %s: %v", trackerURL, err)
+	}
+}
+
+func TestTrackerServerEndToEnd(t *testing.T) {
+	server := newTrackerServer(time.Minute, nil)
+	httpURL, udpURL := startTrackerServer(t, server)
+	path, infoHash := writeTestTorrent(t, [][]string{{httpURL}, {udpURL}})
+
+	announceAs(t, httpURL, infoHash, "-AA0001-aaaaaaaaaaaa", 7001, EventStarted)
+	announceAs(t, udpURL, infoHash, "-BB0001-bbbbbbbbbbbb", 7002, EventStarted)
+
+	output := captureStdout(t, func() { executePeers([]string{path}) })
+	peers := strings.Fields(output)
+	slices.Sort(peers)
+	if want := []string{"127.0.0.1:7001", "127.0.0.1:7002"}; !slices.Equal(peers, want) {
+		t.Errorf("peers printed %q, want %q", peers, want)
+	}
+}
+
+func TestTrackerServerKeepsUDPPeerIDs(t *testing.T) {
+	server := newTrackerServer(time.Minute, nil)
+	httpURL, udpURL := startTrackerServer(t, server)
+	infoHash := make([]byte, 20)
+
+	announceAs(t, udpURL, infoHash, "-AA0001-aaaaaaaaaaaa", 7001, EventStarted)
+	announceAs(t, udpURL, infoHash, "-BB0001-bbbbbbbbbbbb", 7002, EventStarted)
+
+	params := url.Values{}
+	params.Set("info_hash", string(infoHash))
+	params.Set("peer_id", "-CC0001-cccccccccccc")
+	params.Set("port", "7003")
+	resp, err := http.Get(httpURL + "?" + params.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response TrackerResponse
+	if err := Unmarshal(body, &response); err != nil {
+		t.Fatal(err)
+	}
+	var trackerPeers []TrackerPeer
+	if err := Unmarshal(response.Peers, &trackerPeers); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make(map[int]string)
+	for _, peer := range trackerPeers {
+		ids[peer.Port] = string(peer.PeerID)
+	}
+	if ids[7001] != "-AA0001-aaaaaaaaaaaa" || ids[7002] != "-BB0001-bbbbbbbbbbbb" {
+		t.Errorf("peer ids %q", ids)
+	}
+}
+
+func TestTrackerServerForgetsEmptySwarms(t *testing.T) {
+	server := newTrackerServer(10*time.Millisecond, nil)
+	stopped := serverAnnounce{
+		infoHash: make([]byte, 20),
+		peer:     Peer{Addr: netip.MustParseAddr("10.0.0.1"), Port: 7001},
+		event:    EventStarted,
+	}
+	if _, _, err := server.announce(stopped); err != nil {
+		t.Fatal(err)
+	}
+	stopped.event = EventStopped
+	if _, _, err := server.announce(stopped); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.swarms) != 0 {
+		t.Fatalf("%d swarms left after the last peer stopped", len(server.swarms))
+	}
+
+	idle := serverAnnounce{infoHash: make([]byte, 20), peer: stopped.peer, event: EventStarted}
+	if _, _, err := server.announce(idle); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	other := serverAnnounce{infoHash: []byte("01234567890123456789"), peer: stopped.peer, event: EventStarted}
+	if _, _, err := server.announce(other); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := server.swarms[string(idle.infoHash)]; ok || len(server.swarms) != 1 {
+		t.Errorf("swarm whose peers expired is still tracked")
+	}
+}
+
+func TestTrackerServerUDPConnectionIDs(t *testing.T) {
+	server := newTrackerServer(time.Minute, nil)
+	client := netip.MustParseAddrPort("10.0.0.1:6881")
+	id := server.newUDPConnectionID(client)
+
+	if !server.validUDPConnectionID(id, client) {
+		t.Error("connection id rejected for the client it was handed to")
+	}
+	if !server.validUDPConnectionID(id, netip.MustParseAddrPort("[::ffff:10.0.0.1]:6881")) {
+		t.Error("connection id rejected for the same client as a mapped address")
+	}
+	if server.validUDPConnectionID(id, netip.MustParseAddrPort("10.0.0.2:6881")) {
+		t.Error("connection id accepted from another address")
+	}
+	if !server.validUDPConnectionID(id, netip.MustParseAddrPort("10.0.0.1:6882")) {
+		t.Error("connection id rejected from another socket of the client")
+	}
+	if newTrackerServer(time.Minute, nil).validUDPConnectionID(id, client) {
+		t.Error("connection id accepted by a tracker with another secret")
+	}
+
+	expired := server.udpConnectionID(client, udpConnectionWindow(time.Now())-2)
+	if server.validUDPConnectionID(expired, client) {
+		t.Error("expired connection id accepted")
+	}
+}
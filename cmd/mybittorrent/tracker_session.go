@@ -0,0 +1,240 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// TrackerSession keeps a torrent announced to its trackers for the duration of
+// a download: it sends the started, completed and stopped events, reports the
+// transfer counters and re-announces at the interval the tracker asks for.
+// When local service discovery is enabled it also re-announces the torrent on
+// the local network every lsdInterval.
+type TrackerSession struct {
+	tiers   *TrackerTiers
+	request AnnounceRequest
+
+	lsd         []*LSD
+	lsdInterval time.Duration
+
+	mu          sync.Mutex
+	uploaded    int64
+	downloaded  int64
+	left        int64
+	trackerIDs  map[string]string
+	interval    time.Duration
+	minInterval time.Duration
+
+	peers   chan []Peer
+	stop    chan struct{}
+	done    chan struct{}
+	started bool
+}
+
+func newTrackerSession(metainfo *Metainfo) *TrackerSession {
+	request := newAnnounceRequest(metainfo)
+	return &TrackerSession{
+		tiers:       newTrackerTiers(metainfo),
+		request:     *request,
+		left:        request.Left,
+		trackerIDs:  make(map[string]string),
+		lsdInterval: lsdAnnounceInterval,
+		peers:       make(chan []Peer, 1),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// Start sends the started event and returns the peers of the first tracker
+// that answers, along with any found on the local network. From then on the
+// session re-announces in the background until Stop is called.
+func (s *TrackerSession) Start() ([]Peer, error) {
+	lookupEnd := time.Now().Add(lsdLookupTimeout)
+	if lsdEnabled() {
+		nodes, err := joinLSD(s.request.InfoHash)
+		if err != nil {
+			log.Println("local service discovery failed", err)
+		}
+		s.lsd = nodes
+	}
+
+	peers, err := s.announce(EventStarted)
+	if len(s.lsd) > 0 {
+		time.Sleep(time.Until(lookupEnd))
+		peers = mergePeers(s.localPeers(), peers)
+	}
+	if err != nil && len(peers) == 0 {
+		s.closeLSD()
+		return nil, err
+	}
+	s.started = true
+	go s.run()
+	return peers, nil
+}
+
+// Peers delivers the peers returned by re-announces and found on the local
+// network. Results that are not picked up yet are merged with the next ones.
+func (s *TrackerSession) Peers() <-chan []Peer {
+	return s.peers
+}
+
+func (s *TrackerSession) AddUploaded(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.uploaded += int64(n)
+}
+
+func (s *TrackerSession) AddDownloaded(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.downloaded += int64(n)
+}
+
+// AddVerified records that n more bytes of the torrent are on disk and
+// verified, decreasing the amount left to download.
+func (s *TrackerSession) AddVerified(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.left = max(s.left-int64(n), 0)
+}
+
+// SetLeft sets the amount left to download, for torrents whose size is not
+// known until their metadata has been fetched.
+func (s *TrackerSession) SetLeft(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.left = int64(n)
+}
+
+// Completed tells the trackers that the download finished.
+func (s *TrackerSession) Completed() error {
+	if s.tiers.Len() == 0 {
+		return nil
+	}
+	_, err := s.announce(EventCompleted)
+	return err
+}
+
+// Stop ends the background re-announces and sends the stopped event.
+func (s *TrackerSession) Stop() error {
+	if s.started {
+		close(s.stop)
+		<-s.done
+		s.started = false
+	}
+	s.closeLSD()
+	if s.tiers.Len() == 0 {
+		return nil
+	}
+	_, err := s.announce(EventStopped)
+	return err
+}
+
+func (s *TrackerSession) run() {
+	defer close(s.done)
+	timer := time.NewTimer(s.nextAnnounce())
+	defer timer.Stop()
+	var lsdTick <-chan time.Time
+	if len(s.lsd) > 0 {
+		ticker := time.NewTicker(s.lsdInterval)
+		defer ticker.Stop()
+		lsdTick = ticker.C
+	}
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-lsdTick:
+			for _, l := range s.lsd {
+				if err := l.Announce(s.request.InfoHash); err != nil {
+					log.Println(err)
+				}
+			}
+			if peers := s.localPeers(); len(peers) > 0 {
+				s.deliver(peers)
+			}
+		case <-timer.C:
+			peers, err := s.announce(EventNone)
+			timer.Reset(s.nextAnnounce())
+			if err != nil {
+				log.Println("unable to re-announce to trackers", err)
+				continue
+			}
+			s.deliver(peers)
+		}
+	}
+}
+
+// deliver hands peers to Peers, merged with those not picked up yet.
+func (s *TrackerSession) deliver(peers []Peer) {
+	select {
+	case pending := <-s.peers:
+		peers = mergePeers(pending, peers)
+	default:
+	}
+	s.peers <- peers
+}
+
+func (s *TrackerSession) localPeers() []Peer {
+	var peers []Peer
+	for _, l := range s.lsd {
+		peers = append(peers, l.Peers(s.request.InfoHash)...)
+	}
+	return peers
+}
+
+func (s *TrackerSession) closeLSD() {
+	for _, l := range s.lsd {
+		l.Close()
+	}
+	s.lsd = nil
+}
+
+// nextAnnounce is the time to wait before re-announcing: the interval of the
+// last response, but never less than its min interval.
+func (s *TrackerSession) nextAnnounce() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	interval := s.interval
+	if interval <= 0 {
+		interval = defaultAnnounceInterval
+	}
+	return max(interval, s.minInterval)
+}
+
+func (s *TrackerSession) announce(event AnnounceEvent) ([]Peer, error) {
+	s.mu.Lock()
+	request := s.request
+	request.Uploaded = s.uploaded
+	request.Downloaded = s.downloaded
+	request.Left = s.left
+	request.Event = event
+	s.mu.Unlock()
+
+	return s.tiers.Announce(func(trackerURL string) ([]Peer, error) {
+		request := request
+		s.mu.Lock()
+		request.TrackerID = s.trackerIDs[trackerURL]
+		s.mu.Unlock()
+
+		response, err := announce(trackerURL, &request)
+		if err != nil {
+			return nil, err
+		}
+		if response.Warning != nil {
+			log.Println(trackerURL, response.Warning)
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if response.TrackerID != "" {
+			s.trackerIDs[trackerURL] = response.TrackerID
+		}
+		s.interval = response.Interval
+		s.minInterval = response.MinInterval
+		return response.Peers, nil
+	}, false)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTrackerTiersPromotesAnsweringTracker(t *testing.T) {
+	tiers := &TrackerTiers{tiers: [][]string{{"a", "b", "c"}, {"d"}}}
+	_, err := tiers.Announce(func(trackerURL string) ([]Peer, error) {
+		if trackerURL != "c" {
+			return nil, errors.New("down")
+		}
+		return nil, nil
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tiers.URLs(), []string{"c", "a", "b", "d"}; !slices.Equal(got, want) {
+		t.Errorf("trackers %v, want %v", got, want)
+	}
+}
+
+func TestTrackerTiersAnnounceDoesNotBlockOtherCallers(t *testing.T) {
+	tiers := &TrackerTiers{tiers: [][]string{{"slow"}}}
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go tiers.Announce(func(string) ([]Peer, error) {
+		close(started)
+		<-release
+		return nil, nil
+	}, false)
+	defer close(release)
+	<-started
+
+	done := make(chan struct{})
+	go func() {
+		tiers.Announce(func(string) ([]Peer, error) { return nil, nil }, false)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("announce waited for another announce in progress")
+	}
+}
+
+func TestHTTPTrackerRejectsBadResponses(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		want    string
+	}{
+		{"error status", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "<html>down for maintenance</html>", http.StatusServiceUnavailable)
+		}, "503"},
+		{"oversized body", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(strings.Repeat("x", maxTrackerResponseSize+1)))
+		}, "exceeds"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(tt.handler)
+			defer server.Close()
+			u, err := url.Parse(server.URL + "/announce")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = announceHTTP(u, testAnnounceRequest())
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("announce: got %v, want an error mentioning %q", err, tt.want)
+			}
+			_, err = scrapeHTTP(u, [][]byte{make([]byte, 20)})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("scrape: got %v, want an error mentioning %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrackerTiersAnnouncesToAllAtOnce(t *testing.T) {
+	tiers := &TrackerTiers{tiers: [][]string{{"a", "b"}, {"c"}}}
+	peer := func(port uint16) Peer { return Peer{Addr: netip.MustParseAddr("10.0.0.1"), Port: port} }
+	var mu sync.Mutex
+	waiting := 0
+	ready := make(chan struct{})
+	peers, err := tiers.Announce(func(trackerURL string) ([]Peer, error) {
+		// every tracker waits for the others, so asking them in turn would
+		// never get past the first
+		mu.Lock()
+		if waiting++; waiting == 3 {
+			close(ready)
+		}
+		mu.Unlock()
+		select {
+		case <-ready:
+		case <-time.After(5 * time.Second):
+			return nil, errors.New("trackers were asked one at a time")
+		}
+		switch trackerURL {
+		case "a":
+			return nil, errors.New("down")
+		case "b":
+			return []Peer{peer(1), peer(2)}, nil
+		}
+		return []Peer{peer(2), peer(3)}, nil
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Peer{peer(1), peer(2), peer(3)}; !slices.EqualFunc(peers, want, func(a, b Peer) bool { return a.AddrPort() == b.AddrPort() }) {
+		t.Errorf("got peers %v, want %v", peers, want)
+	}
+}
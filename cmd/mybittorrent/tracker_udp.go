@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// UDP tracker protocol constants (BEP 15).
+const (
+	udpProtocolID     = 0x41727101980
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+
+	// udpConnectionIDLifetime is how long a client may use a connection ID.
+	udpConnectionIDLifetime = time.Minute
+	// udpTrackerTimeout is the initial response timeout, doubled after every
+	// retransmission up to udpTrackerMaxRetries times. BEP 15 allows eight
+	// retransmissions, over two hours in total; a client gives up on a
+	// tracker after less than two minutes and tries the next one instead.
+	udpTrackerTimeout    = 15 * time.Second
+	udpTrackerMaxRetries = 2
+	// udpScrapeMaxHashes is the number of info hashes that fit in a scrape
+	// request.
+	udpScrapeMaxHashes = 74
+)
+
+var errUDPTrackerTimeout = errors.New("udp tracker did not respond")
+
+type udpConnectionID struct {
+	id      uint64
+	expires time.Time
+}
+
+// udpConnectionIDs caches connection IDs by tracker address, so consecutive
+// requests to a tracker within a minute skip the connect exchange.
+var udpConnectionIDs = struct {
+	sync.Mutex
+	ids map[string]udpConnectionID
+}{ids: make(map[string]udpConnectionID)}
+
+type UDPTracker struct {
+	conn       net.PacketConn
+	addr       net.Addr
+	timeout    time.Duration
+	maxRetries int
+	// ipv6 is whether the tracker is reached over IPv6, and source the
+	// address it answers from. They are only known once the tracker answers
+	// when the proxy resolves its host name.
+	ipv6   bool
+	source netip.AddrPort
+}
+
+func dialUDPTracker(u *url.URL) (*UDPTracker, error) {
+	if u.Port() == "" {
+		return nil, fmt.Errorf("udp tracker url %s has no port", u)
+	}
+	addr, err := resolveUDPAddr("udp", u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve udp tracker: %w", err)
+	}
+	conn, err := listenUDP()
+	if err != nil {
+		return nil, fmt.Errorf("unable to open udp socket: %w", err)
+	}
+	tracker := &UDPTracker{
+		conn:       conn,
+		addr:       addr,
+		timeout:    udpTrackerTimeout,
+		maxRetries: udpTrackerMaxRetries,
+	}
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		tracker.ipv6 = udpAddr.IP.To4() == nil
+	}
+	return tracker, nil
+}
+
+func (t *UDPTracker) Close() error {
+	return t.conn.Close()
+}
+
+// isIPv6 reports whether the tracker is reached over IPv6, in which case it
+// answers announces with 18 byte IPv6 peers instead of 6 byte IPv4 ones.
+func (t *UDPTracker) isIPv6() bool {
+	return t.ipv6
+}
+
+// fromTracker reports whether a datagram from addr was sent by the tracker.
+// When the proxy resolves the tracker's host name only its port is known
+// until it first answers, and later answers must come from the same address.
+func (t *UDPTracker) fromTracker(addr net.Addr) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	from := netip.AddrPortFrom(udpAddr.AddrPort().Addr().Unmap(), udpAddr.AddrPort().Port())
+	switch tracker := t.addr.(type) {
+	case *net.UDPAddr:
+		return from == netip.AddrPortFrom(tracker.AddrPort().Addr().Unmap(), tracker.AddrPort().Port())
+	case hostAddr:
+		if t.source.IsValid() {
+			return from == t.source
+		}
+		_, port, err := net.SplitHostPort(string(tracker))
+		if err != nil || port != strconv.Itoa(int(from.Port())) {
+			return false
+		}
+		t.source = from
+		return true
+	}
+	return false
+}
+
+// udpAnnounceEvents maps announce events to their code in UDP requests.
+var udpAnnounceEvents = map[AnnounceEvent]uint32{
+	EventNone:      0,
+	EventCompleted: 1,
+	EventStarted:   2,
+	EventStopped:   3,
+}
+
+func announceUDP(u *url.URL, request *AnnounceRequest) (*AnnounceResponse, error) {
+	tracker, err := dialUDPTracker(u)
+	if err != nil {
+		return nil, err
+	}
+	defer tracker.Close()
+
+	payload := make([]byte, 0, 82)
+	payload = append(payload, request.InfoHash...)
+	payload = append(payload, request.PeerID...)
+	payload = binary.BigEndian.AppendUint64(payload, uint64(request.Downloaded))
+	payload = binary.BigEndian.AppendUint64(payload, uint64(request.Left))
+	payload = binary.BigEndian.AppendUint64(payload, uint64(request.Uploaded))
+	payload = binary.BigEndian.AppendUint32(payload, udpAnnounceEvents[request.Event])
+	payload = binary.BigEndian.AppendUint32(payload, 0) // IP address: sender's
+	payload = binary.BigEndian.AppendUint32(payload, request.Key)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(int32(request.NumWant)))
+	payload = binary.BigEndian.AppendUint16(payload, uint16(request.Port))
+
+	response, err := tracker.Request(udpActionAnnounce, payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < 12 {
+		return nil, fmt.Errorf("udp announce response too short: %d bytes", len(response))
+	}
+	addrLen := net.IPv4len
+	if tracker.isIPv6() {
+		addrLen = net.IPv6len
+	}
+	return &AnnounceResponse{
+		Interval: time.Duration(binary.BigEndian.Uint32(response[0:4])) * time.Second,
+		Leechers: int(binary.BigEndian.Uint32(response[4:8])),
+		Seeders:  int(binary.BigEndian.Uint32(response[8:12])),
+		Peers:    parseCompactPeers(response[12:], addrLen),
+	}, nil
+}
+
+// scrapeUDP asks a UDP tracker for the swarm stats of every info hash,
+// splitting the request when there are more hashes than fit in a packet.
+func scrapeUDP(u *url.URL, infoHashes [][]byte) ([]ScrapeStats, error) {
+	tracker, err := dialUDPTracker(u)
+	if err != nil {
+		return nil, err
+	}
+	defer tracker.Close()
+
+	stats := make([]ScrapeStats, 0, len(infoHashes))
+	for start := 0; start < len(infoHashes); start += udpScrapeMaxHashes {
+		batch := infoHashes[start:min(start+udpScrapeMaxHashes, len(infoHashes))]
+		request := make([]byte, 0, len(batch)*20)
+		for _, infoHash := range batch {
+			request = append(request, infoHash...)
+		}
+
+		response, err := tracker.Request(udpActionScrape, request)
+		if err != nil {
+			return nil, err
+		}
+		if len(response) < len(batch)*12 {
+			return nil, fmt.Errorf("udp scrape response has %d bytes for %d torrents", len(response), len(batch))
+		}
+		for i := range batch {
+			entry := response[i*12 : (i+1)*12]
+			stats = append(stats, ScrapeStats{
+				Complete:   int(binary.BigEndian.Uint32(entry[0:4])),
+				Downloaded: int(binary.BigEndian.Uint32(entry[4:8])),
+				Incomplete: int(binary.BigEndian.Uint32(entry[8:12])),
+			})
+		}
+	}
+	return stats, nil
+}
+
+// Request sends an announce or scrape request and returns the response
+// payload following the action and transaction ID. A request that is not
+// answered within the timeout is retransmitted, waiting 15 * 2^n seconds for
+// the nth retransmission, and a fresh connection ID is obtained if the cached one
+// expired in the meantime.
+func (t *UDPTracker) Request(action uint32, payload []byte) ([]byte, error) {
+	for n := 0; n <= t.maxRetries; n++ {
+		deadline := time.Now().Add(t.timeout << n)
+		connectionID, err := t.connectionID(deadline)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		response, err := t.exchange(connectionID, action, payload, deadline)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		}
+		return response, err
+	}
+	return nil, errUDPTrackerTimeout
+}
+
+func (t *UDPTracker) connectionID(deadline time.Time) (uint64, error) {
+	key := t.addr.String()
+
+	udpConnectionIDs.Lock()
+	cached, ok := udpConnectionIDs.ids[key]
+	udpConnectionIDs.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.id, nil
+	}
+
+	response, err := t.exchange(udpProtocolID, udpActionConnect, nil, deadline)
+	if err != nil {
+		return 0, err
+	}
+	if len(response) < 8 {
+		return 0, fmt.Errorf("udp connect response too short: %d bytes", len(response))
+	}
+	id := binary.BigEndian.Uint64(response)
+
+	udpConnectionIDs.Lock()
+	udpConnectionIDs.ids[key] = udpConnectionID{id: id, expires: time.Now().Add(udpConnectionIDLifetime)}
+	udpConnectionIDs.Unlock()
+	return id, nil
+}
+
+// exchange sends one request and waits until deadline for the response with
+// a matching transaction ID, ignoring any other packets.
+func (t *UDPTracker) exchange(connectionID uint64, action uint32, payload []byte, deadline time.Time) ([]byte, error) {
+	transactionID := rand.Uint32()
+	packet := make([]byte, 0, 16+len(payload))
+	packet = binary.BigEndian.AppendUint64(packet, connectionID)
+	packet = binary.BigEndian.AppendUint32(packet, action)
+	packet = binary.BigEndian.AppendUint32(packet, transactionID)
+	packet = append(packet, payload...)
+
+	if err := t.conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	if _, err := t.conn.WriteTo(packet, t.addr); err != nil {
+		return nil, fmt.Errorf("unable to send udp tracker request: %w", err)
+	}
+
+	buffer := make([]byte, 64*1024)
+	for {
+		read, from, err := t.conn.ReadFrom(buffer)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return nil, err
+			}
+			return nil, fmt.Errorf("unable to read udp tracker response: %w", err)
+		}
+		if read < 8 || binary.BigEndian.Uint32(buffer[4:8]) != transactionID || !t.fromTracker(from) {
+			continue
+		}
+
+		if udpAddr, ok := from.(*net.UDPAddr); ok {
+			t.ipv6 = udpAddr.IP.To4() == nil
+		}
+
+		response := buffer[8:read]
+		switch responseAction := binary.BigEndian.Uint32(buffer[0:4]); responseAction {
+		case action:
+			return append([]byte(nil), response...), nil
+		case udpActionError:
+			return nil, &TrackerFailureError{Reason: string(response)}
+		default:
+			return nil, fmt.Errorf("udp tracker answered action %d with action %d", action, responseAction)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeUDPTracker answers BEP 15 requests with a fixed peer list. It ignores
+// the first drop packets to make the client retransmit, and answers every
+// request with an error when failure is set. With spoof set, every answer
+// is preceded by a forged copy sent from that socket.
+type fakeUDPTracker struct {
+	conn    net.PacketConn
+	peers   []Peer
+	drop    int
+	failure string
+	spoof   net.PacketConn
+
+	mu       sync.Mutex
+	packets  int
+	connects int
+}
+
+func newFakeUDPTracker(t *testing.T, configure func(*fakeUDPTracker)) *fakeUDPTracker {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := &fakeUDPTracker{conn: conn}
+	if configure != nil {
+		configure(tracker)
+	}
+	go tracker.serve()
+	t.Cleanup(func() { conn.Close() })
+	return tracker
+}
+
+func (f *fakeUDPTracker) url() *url.URL {
+	return &url.URL{Scheme: "udp", Host: f.conn.LocalAddr().String()}
+}
+
+func (f *fakeUDPTracker) serve() {
+	buffer := make([]byte, 2048)
+	for {
+		read, addr, err := f.conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		response := f.handle(buffer[:read])
+		if response == nil {
+			continue
+		}
+		if f.spoof != nil {
+			forged := bytes.Clone(response)
+			forged[len(forged)-1] ^= 0xff
+			f.spoof.WriteTo(forged, addr)
+		}
+		f.conn.WriteTo(response, addr)
+	}
+}
+
+func (f *fakeUDPTracker) handle(packet []byte) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.packets++
+	if f.packets <= f.drop || len(packet) < 16 {
+		return nil
+	}
+
+	action := binary.BigEndian.Uint32(packet[8:12])
+	response := append([]byte(nil), packet[8:16]...)
+	if f.failure != "" {
+		binary.BigEndian.PutUint32(response, udpActionError)
+		return append(response, f.failure...)
+	}
+	switch action {
+	case udpActionConnect:
+		f.connects++
+		return binary.BigEndian.AppendUint64(response, 0x1234)
+	case udpActionAnnounce:
+		response = binary.BigEndian.AppendUint32(response, 1800)
+		response = binary.BigEndian.AppendUint32(response, 1)
+		response = binary.BigEndian.AppendUint32(response, 2)
+		for _, peer := range f.peers {
+			response = appendCompactPeer(response, peer)
+		}
+		return response
+	case udpActionScrape:
+		for range (len(packet) - 16) / 20 {
+			response = binary.BigEndian.AppendUint32(response, 3)
+			response = binary.BigEndian.AppendUint32(response, 4)
+			response = binary.BigEndian.AppendUint32(response, 5)
+		}
+		return response
+	}
+	return nil
+}
+
+func (f *fakeUDPTracker) counts() (packets, connects int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.packets, f.connects
+}
+
+func testAnnounceRequest() *AnnounceRequest {
+	return &AnnounceRequest{
+		InfoHash: make([]byte, 20),
+		PeerID:   "-TE0001-000000000000",
+		Port:     6881,
+		Left:     100,
+		NumWant:  50,
+		Event:    EventStarted,
+	}
+}
+
+func TestAnnounceUDP(t *testing.T) {
+	peer := Peer{Addr: netip.MustParseAddr("10.0.0.1"), Port: 6881}
+	tracker := newFakeUDPTracker(t, func(f *fakeUDPTracker) { f.peers = []Peer{peer} })
+
+	for range 2 {
+		response, err := announceUDP(tracker.url(), testAnnounceRequest())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.Interval != 1800*time.Second || response.Leechers != 1 || response.Seeders != 2 {
+			t.Errorf("unexpected response %+v", response)
+		}
+		if len(response.Peers) != 1 || response.Peers[0].AddrPort() != peer.AddrPort() {
+			t.Errorf("peers %v, want %v", response.Peers, peer)
+		}
+	}
+	if _, connects := tracker.counts(); connects != 1 {
+		t.Errorf("connected %d times, want the connection id to be reused", connects)
+	}
+}
+
+func TestAnnounceUDPIgnoresOtherSources(t *testing.T) {
+	spoof, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spoof.Close()
+	peer := Peer{Addr: netip.MustParseAddr("10.0.0.1"), Port: 6881}
+	tracker := newFakeUDPTracker(t, func(f *fakeUDPTracker) {
+		f.peers = []Peer{peer}
+		f.spoof = spoof
+	})
+
+	response, err := announceUDP(tracker.url(), testAnnounceRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Peers) != 1 || response.Peers[0].AddrPort() != peer.AddrPort() {
+		t.Errorf("peers %v, want %v from the tracker", response.Peers, peer)
+	}
+}
+
+func TestScrapeUDP(t *testing.T) {
+	tracker := newFakeUDPTracker(t, nil)
+	infoHashes := make([][]byte, udpScrapeMaxHashes+1)
+	for i := range infoHashes {
+		infoHashes[i] = make([]byte, 20)
+	}
+	stats, err := scrapeUDP(tracker.url(), infoHashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != len(infoHashes) {
+		t.Fatalf("got %d stats, want %d", len(stats), len(infoHashes))
+	}
+	if want := (ScrapeStats{Complete: 3, Downloaded: 4, Incomplete: 5}); stats[len(stats)-1] != want {
+		t.Errorf("stats %+v, want %+v", stats[len(stats)-1], want)
+	}
+}
+
+func testUDPTracker(t *testing.T, fake *fakeUDPTracker) *UDPTracker {
+	tracker, err := dialUDPTracker(fake.url())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker.timeout = 20 * time.Millisecond
+	t.Cleanup(func() { tracker.Close() })
+	return tracker
+}
+
+func TestUDPTrackerRetransmits(t *testing.T) {
+	fake := newFakeUDPTracker(t, func(f *fakeUDPTracker) { f.drop = 2 })
+	tracker := testUDPTracker(t, fake)
+	if _, err := tracker.Request(udpActionScrape, make([]byte, 20)); err != nil {
+		t.Fatal(err)
+	}
+	if packets, _ := fake.counts(); packets != 4 {
+		t.Errorf("tracker received %d packets, want 2 dropped connects, a connect and a scrape", packets)
+	}
+}
+
+func TestUDPTrackerGivesUp(t *testing.T) {
+	fake := newFakeUDPTracker(t, func(f *fakeUDPTracker) { f.drop = 100 })
+	tracker := testUDPTracker(t, fake)
+	_, err := tracker.Request(udpActionScrape, make([]byte, 20))
+	if !errors.Is(err, errUDPTrackerTimeout) {
+		t.Fatalf("got %v, want %v", err, errUDPTrackerTimeout)
+	}
+	if packets, _ := fake.counts(); packets != udpTrackerMaxRetries+1 {
+		t.Errorf("tracker received %d packets, want %d", packets, udpTrackerMaxRetries+1)
+	}
+}
+
+func TestUDPTrackerError(t *testing.T) {
+	fake := newFakeUDPTracker(t, func(f *fakeUDPTracker) { f.failure = "torrent not registered" })
+	_, err := announceUDP(fake.url(), testAnnounceRequest())
+	var failure *TrackerFailureError
+	if !errors.As(err, &failure) || failure.Reason != "torrent not registered" {
+		t.Fatalf("got %v, want the tracker's failure reason", err)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+)
+
+// PieceVerifier checks downloaded pieces against the SHA-1 piece hashes of v1
+// torrents and the per-file SHA-256 merkle trees of v2 torrents. Hybrid
+// torrents are checked against both.
+type PieceVerifier struct {
+	v1Hashes [][]byte
+	v2Pieces map[int]v2Piece
+}
+
+// v2Piece is what a piece of a v2 file has to hash to: the matching entry of
+// the file's piece layer, or the pieces root itself for files no larger than
+// a piece.
+type v2Piece struct {
+	length int
+	width  int
+	hash   [sha256.Size]byte
+}
+
+func newPieceVerifier(info *Info, pieceLayers map[string][]byte) (*PieceVerifier, error) {
+	verifier := &PieceVerifier{}
+	if info.HasV1() {
+		verifier.v1Hashes = info.PieceHashes()
+	}
+	if !info.HasV2() {
+		return verifier, nil
+	}
+
+	verifier.v2Pieces = make(map[int]v2Piece)
+	pieceIndex := 0
+	for _, file := range info.V2Files() {
+		if file.Length == 0 {
+			continue
+		}
+		pieceCount := (file.Length + info.PieceLength - 1) / info.PieceLength
+		if pieceCount == 1 {
+			verifier.v2Pieces[pieceIndex] = v2Piece{
+				length: file.Length,
+				width:  merkleWidth((file.Length + merkleBlockSize - 1) / merkleBlockSize),
+				hash:   [sha256.Size]byte(file.PiecesRoot),
+			}
+			pieceIndex++
+			continue
+		}
+
+		layer, ok := pieceLayers[string(file.PiecesRoot)]
+		if !ok {
+			if info.HasV1() {
+				// Hybrid torrents can still be checked against the v1 hashes.
+				pieceIndex += pieceCount
+				continue
+			}
+			return nil, fmt.Errorf("missing piece layer for file %q", file.Path)
+		}
+		for i, hash := range splitHashes(layer) {
+			verifier.v2Pieces[pieceIndex+i] = v2Piece{
+				length: min(info.PieceLength, file.Length-i*info.PieceLength),
+				width:  info.PieceLength / merkleBlockSize,
+				hash:   hash,
+			}
+		}
+		pieceIndex += pieceCount
+	}
+	return verifier, nil
+}
+
+// Verify returns an error unless data is the correct content of the piece at
+// index.
+func (v *PieceVerifier) Verify(index int, data []byte) error {
+	if v.v1Hashes != nil {
+		if index >= len(v.v1Hashes) {
+			return fmt.Errorf("piece index %d out of range", index)
+		}
+		sum := sha1.Sum(data)
+		if !bytes.Equal(v.v1Hashes[index], sum[:]) {
+			return fmt.Errorf("invalid hash of piece %d. want: %x, got: %x", index, v.v1Hashes[index], sum[:])
+		}
+	}
+
+	if v.v2Pieces != nil {
+		piece, ok := v.v2Pieces[index]
+		if !ok {
+			if v.v1Hashes != nil {
+				return nil
+			}
+			return fmt.Errorf("piece index %d out of range", index)
+		}
+		if len(data) < piece.length {
+			return fmt.Errorf("piece %d is %d bytes, want %d", index, len(data), piece.length)
+		}
+		// Anything after piece.length is padding that only exists in the v1
+		// view of a hybrid torrent.
+		root := merkleRoot(blockHashes(data[:piece.length]), piece.width, [sha256.Size]byte{})
+		if root != piece.hash {
+			return fmt.Errorf("invalid merkle root of piece %d. want: %x, got: %x", index, piece.hash, root)
+		}
+	}
+	return nil
+}